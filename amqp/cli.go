@@ -0,0 +1,298 @@
+package amqp
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "context"
+  "net/url"
+  "github.com/golang/glog"
+  "github.com/streadway/amqp"
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/manifest"
+)
+
+var (
+  ContentType = "application/json"
+  // max wait between connect attempts, doubled from one second on failure
+  ReconnectMax = common.GetEnvOr("AMQP_RECONNECT_MAX", "2m")
+)
+
+// Subset of AMQP channel used by Sub, satisfied by *amqp.Channel and the
+// channel of the fake broker in tests
+type Channel interface {
+  Qos(prefetch_count, prefetch_size int, global bool) error
+  Consume(queue, consumer string, auto_ack, exclusive, no_local, no_wait bool,
+    args amqp.Table) (<-chan amqp.Delivery, error)
+  Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+  NotifyClose(c chan *amqp.Error) chan *amqp.Error
+  Close() error
+}
+
+// Opens channel to broker given in subscription manifest
+type Dialer func(mani *manifest.SubManifest) (Channel, error)
+
+// Channel which owns its connection
+type connChannel struct {
+  *amqp.Channel
+  conn *amqp.Connection
+}
+
+func (self *connChannel) Close() error {
+  self.Channel.Close()
+  return self.conn.Close()
+}
+
+// Connect with amqp:// or amqps:// uri, TLS settings of manifest apply to
+// the latter
+func Dial(mani *manifest.SubManifest) (Channel, error) {
+  u, err := url.Parse(mani.Uri)
+  if err != nil { return nil, err }
+
+  if mani.Cred.User != "" {
+    u.User = url.UserPassword(mani.Cred.User, mani.Cred.Pass)
+  }
+
+  var conn *amqp.Connection
+  if u.Scheme == "amqps" && mani.Tls != nil {
+    cfg, e := mani.Tls.Config()
+    if e != nil {
+      return nil, fmt.Errorf("invalid tls config: %v", e)
+    }
+    conn, err = amqp.DialTLS(u.String(), cfg)
+  } else {
+    conn, err = amqp.Dial(u.String())
+  }
+  if err != nil { return nil, err }
+
+  ch, err := conn.Channel()
+  if err != nil {
+    conn.Close()
+    return nil, err
+  }
+  return &connChannel{Channel: ch, conn: conn}, nil
+}
+
+// Consumes update manifests from queues and publishes events and heartbeats
+// to exchange, a manifest is acked only after handler returns, which is once
+// a two-phase or out of window manifest is saved to disk as staged or queued,
+// not after its components are set up
+type Sub struct {
+  common.MsgHandler
+  mani *manifest.SubManifest
+  dial Dialer
+  // queues consumed
+  queues []string
+  ch_mutex *sync.Mutex
+  ch Channel
+}
+
+func NewSub(h common.MsgHandler, mani *manifest.SubManifest) *Sub {
+  return NewSubWithDialer(h, mani, Dial)
+}
+
+func NewSubWithDialer(h common.MsgHandler, mani *manifest.SubManifest, dial Dialer) *Sub {
+  return &Sub{
+    MsgHandler: h,
+    mani: mani,
+    dial: dial,
+    ch_mutex: &sync.Mutex{},
+  }
+}
+
+// Queue defined in subscription manifest by key, topic if no such queue
+func (s *Sub) Topic(key string) string {
+  if queue := s.mani.Queues[key]; queue != "" {
+    return queue
+  }
+  return s.mani.Topics[key]
+}
+
+// Consume update manifest and activate queues
+func (s *Sub) SubUpdate() {
+  glog.Infof("%s", common.CurrentScope())
+
+  s.queues = []string{s.Topic(common.TopicUpdateManifest)}
+  for _, key := range []string{common.TopicActivate, common.TopicCommand} {
+    if queue := s.Topic(key); queue != "" {
+      s.queues = append(s.queues, queue)
+    }
+  }
+}
+
+// Connect and consume until context is done, reconnect with backoff if
+// channel is closed
+func (s *Sub) StartSub(ctx context.Context) {
+  glog.Infof("%s", common.CurrentScope())
+
+  max, err := time.ParseDuration(ReconnectMax)
+  if err != nil {
+    glog.Errorf("invalid AMQP_RECONNECT_MAX: %v", err)
+    max = 2 * time.Minute
+  }
+
+  backoff := time.Second
+  for {
+    err := s.serve(ctx)
+    if ctx.Err() != nil { return }
+
+    glog.Errorf("amqp channel closed, reconnect in %v: %v", backoff, err)
+    select {
+    case <-ctx.Done():
+      return
+    case <-time.After(backoff):
+    }
+    if backoff *= 2; backoff > max {
+      backoff = max
+    }
+  }
+}
+
+func (s *Sub) setChannel(ch Channel) {
+  s.ch_mutex.Lock()
+  s.ch = ch
+  s.ch_mutex.Unlock()
+}
+
+func (s *Sub) serve(ctx context.Context) error {
+  ch, err := s.dial(s.mani)
+  if err != nil { return err }
+  defer ch.Close()
+
+  // one manifest at a time, the next is delivered after ack
+  if err := ch.Qos(1, 0, false); err != nil {
+    return err
+  }
+
+  closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+  deliveries := make(chan delivery)
+  for _, queue := range s.queues {
+    dc, err := ch.Consume(queue, "", false, false, false, false, nil)
+    if err != nil {
+      return fmt.Errorf("consume %s failed: %v", queue, err)
+    }
+    go forward(ctx, queue, dc, deliveries)
+  }
+
+  s.setChannel(ch)
+  defer s.setChannel(nil)
+  s.pubPresence(common.PresenceOnline)
+
+  for {
+    select {
+    case <-ctx.Done():
+      s.pubPresence(common.PresenceOffline)
+      return nil
+    case err := <-closed:
+      if err == nil {
+        return fmt.Errorf("channel closed")
+      }
+      return err
+    case d := <-deliveries:
+      s.on_message(d)
+    }
+  }
+}
+
+// Delivery with queue it came from
+type delivery struct {
+  amqp.Delivery
+  queue string
+}
+
+// Pass deliveries of one queue on until it's closed
+func forward(ctx context.Context, queue string, dc <-chan amqp.Delivery, out chan<- delivery) {
+  for d := range dc {
+    select {
+    case out <- delivery{Delivery: d, queue: queue}:
+    case <-ctx.Done():
+      // unacked, broker delivers it again
+      return
+    }
+  }
+}
+
+func (s *Sub) on_message(d delivery) {
+  glog.Infof("%s (%s)", common.CurrentScope(), d.queue)
+
+  if err := s.MsgHandler.Handle(d.queue, d.Body); err != nil {
+    glog.Errorf("message on %s not processed, requeue: %v", d.queue, err)
+    if err := d.Nack(false, true); err != nil {
+      glog.Errorf("nack failed: %v", err)
+    }
+    return
+  }
+
+  if err := d.Ack(false); err != nil {
+    glog.Errorf("ack failed: %v", err)
+  }
+}
+
+func (s *Sub) publish(key string, data []byte) error {
+  s.ch_mutex.Lock()
+  defer s.ch_mutex.Unlock()
+
+  if key == "" {
+    return fmt.Errorf("routing key not defined")
+  }
+
+  if s.ch == nil {
+    return fmt.Errorf("not connected, dropped message to %s", key)
+  }
+  return s.publishOn(s.ch, key, data)
+}
+
+func (s *Sub) publishOn(ch Channel, key string, data []byte) error {
+  return ch.Publish(s.mani.Exchange, key, false, false, amqp.Publishing{
+    ContentType: ContentType,
+    DeliveryMode: amqp.Persistent,
+    Timestamp: time.Now(),
+    Body: data,
+  })
+}
+
+// Open one channel and publish data with each topic as routing key, used by
+// publisher
+func (s *Sub) PushAll(topics []string, data []byte) (map[string]error, error) {
+  glog.Infof("%s (%d key(s))", common.CurrentScope(), len(topics))
+
+  ch, err := s.dial(s.mani)
+  if err != nil { return nil, err }
+  defer ch.Close()
+
+  errs := make(map[string]error)
+  for _, topic := range topics {
+    if err := s.publishOn(ch, topic, data); err != nil {
+      errs[topic] = err
+    }
+  }
+  return errs, nil
+}
+
+func (s *Sub) Publish(key string, data []byte) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), key)
+  return s.publish(s.mani.Topics[key], data)
+}
+
+func (s *Sub) PublishEvent(data []byte) error {
+  glog.Infof("%s", common.CurrentScope())
+  return s.publish(s.mani.Topics[common.TopicEvent], data)
+}
+
+func (s *Sub) PublishHeartbeat(data []byte) error {
+  glog.Infof("%s", common.CurrentScope())
+  return s.publish(s.mani.Topics[common.TopicHeartbeat], data)
+}
+
+// AMQP has neither retained messages nor last will, presence is sent as is
+func (s *Sub) PublishPresence(p *common.Presence) error {
+  topic := s.mani.Topics[common.TopicStatus]
+  if topic == "" { return nil }
+  return s.publish(topic, p.Encode())
+}
+
+func (s *Sub) pubPresence(state common.PresenceState) {
+  if err := s.PublishPresence(common.NewPresence(state)); err != nil {
+    glog.Errorf("failed to publish presence: %v", err)
+  }
+}
@@ -0,0 +1,131 @@
+package amqp
+
+import (
+  "time"
+  "errors"
+  "context"
+  "testing"
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/manifest"
+)
+
+// Handler which takes a while and fails messages as many times as given
+type slowHandler struct {
+  handled chan string
+  // failures left by message
+  fails map[string]int
+}
+
+func (h *slowHandler) Handle(topic string, data []byte) error {
+  time.Sleep(200 * time.Millisecond)
+  if h.fails[string(data)] > 0 {
+    h.fails[string(data)]--
+    return errors.New("not now")
+  }
+  h.handled <- string(data)
+  return nil
+}
+
+func (h *slowHandler) next(t *testing.T) string {
+  select {
+  case data := <-h.handled:
+    return data
+  case <-time.After(5 * time.Second):
+    t.Fatal("nothing handled")
+    return ""
+  }
+}
+
+// Run Sub against fake broker
+func TestSub(t *testing.T) {
+  mani := &manifest.SubManifest{
+    Uri: "amqp://fake",
+    Exchange: "updater",
+    Queues: map[string]string{
+      common.TopicUpdateManifest: "update_manifest.test",
+    },
+    Topics: map[string]string{
+      common.TopicEvent: "event.test",
+      common.TopicStatus: "status.test",
+    },
+  }
+
+  broker := NewFakeBroker()
+  h := &slowHandler{
+    handled: make(chan string, 8),
+    fails: map[string]int{"retry": 1, "transient": 2},
+  }
+  sub := NewSubWithDialer(h, mani, broker.Dial)
+  sub.SubUpdate()
+
+  ctx, cancel := context.WithCancel(context.Background())
+  done := make(chan struct{})
+  go func() {
+    sub.StartSub(ctx)
+    close(done)
+  }()
+
+  // acked only after handler returns
+  broker.Push("update_manifest.test", []byte("first"))
+  time.Sleep(100 * time.Millisecond)
+  if n := broker.Unacked(); n != 1 {
+    t.Fatalf("%d unacked while first is handled", n)
+  }
+  if data := h.next(t); data != "first" {
+    t.Fatalf("handled %s instead of first", data)
+  }
+  time.Sleep(50 * time.Millisecond)
+  if n := len(broker.Acked()); n != 1 {
+    t.Fatalf("%d acked after first is handled", n)
+  }
+
+  // refused message is delivered again
+  broker.Push("update_manifest.test", []byte("retry"))
+  if data := h.next(t); data != "retry" {
+    t.Fatalf("handled %s instead of retry", data)
+  }
+
+  // failed setup keeps being requeued until it's through, acked once
+  acked := len(broker.Acked())
+  broker.Push("update_manifest.test", []byte("transient"))
+  if data := h.next(t); data != "transient" {
+    t.Fatalf("handled %s instead of transient", data)
+  }
+  time.Sleep(50 * time.Millisecond)
+  if n := len(broker.Acked()) - acked; n != 1 {
+    t.Fatalf("transient acked %d times", n)
+  }
+  if n := broker.Unacked(); n != 0 {
+    t.Fatalf("%d unacked after transient is handled", n)
+  }
+
+  // consuming resumes after connection is lost
+  broker.Disconnect()
+  time.Sleep(1500 * time.Millisecond)
+  broker.Push("update_manifest.test", []byte("after"))
+  if data := h.next(t); data != "after" {
+    t.Fatalf("handled %s after reconnect", data)
+  }
+
+  sub.PublishEvent([]byte("{}"))
+  cancel()
+  <-done
+
+  var events, presence int
+  for _, msg := range broker.Published() {
+    if msg.Exchange != "updater" {
+      t.Errorf("published to %s", msg.Exchange)
+    }
+    switch msg.Key {
+    case "event.test": events++
+    case "status.test": presence++
+    }
+  }
+  if events != 1 {
+    t.Errorf("%d events published", events)
+  }
+  // online on both connections and offline on stop
+  if presence != 3 {
+    t.Errorf("%d presence published", presence)
+  }
+}
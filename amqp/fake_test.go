@@ -0,0 +1,235 @@
+package amqp
+
+import (
+  "fmt"
+  "sync"
+  "github.com/streadway/amqp"
+  "github.com/zex/container-update/manifest"
+)
+
+// Message published to fake broker
+type Published struct {
+  Exchange string
+  Key string
+  Body []byte
+}
+
+// In-process broker to run Sub against without RabbitMQ, messages nacked
+// with requeue are delivered again
+type FakeBroker struct {
+  mutex *sync.Mutex
+  queues map[string]chan amqp.Delivery
+  tag uint64
+  // body of delivered messages by tag, until acked
+  unacked map[uint64]amqp.Delivery
+  acked []uint64
+  published []Published
+  ch *fakeChannel
+}
+
+func NewFakeBroker() *FakeBroker {
+  return &FakeBroker{
+    mutex: &sync.Mutex{},
+    queues: make(map[string]chan amqp.Delivery),
+    unacked: make(map[uint64]amqp.Delivery),
+  }
+}
+
+func (self *FakeBroker) queue(name string) chan amqp.Delivery {
+  q, ok := self.queues[name]
+  if !ok {
+    q = make(chan amqp.Delivery, 64)
+    self.queues[name] = q
+  }
+  return q
+}
+
+// Enqueue message to be consumed
+func (self *FakeBroker) Push(queue string, body []byte) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  self.tag++
+  self.queue(queue) <- amqp.Delivery{
+    Acknowledger: self,
+    DeliveryTag: self.tag,
+    RoutingKey: queue,
+    Body: body,
+  }
+}
+
+// Messages published so far
+func (self *FakeBroker) Published() []Published {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return append([]Published(nil), self.published...)
+}
+
+// Tags acked so far
+func (self *FakeBroker) Acked() []uint64 {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return append([]uint64(nil), self.acked...)
+}
+
+// Number of messages delivered but not acked yet
+func (self *FakeBroker) Unacked() int {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return len(self.unacked)
+}
+
+// Drop the open channel as if connection was lost
+func (self *FakeBroker) Disconnect() {
+  self.mutex.Lock()
+  ch := self.ch
+  self.mutex.Unlock()
+
+  if ch != nil {
+    ch.close(&amqp.Error{Code: 320, Reason: "connection forced"})
+  }
+}
+
+// Dialer of Sub
+func (self *FakeBroker) Dial(mani *manifest.SubManifest) (Channel, error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  self.ch = &fakeChannel{broker: self, done: make(chan struct{})}
+  return self.ch, nil
+}
+
+// interface amqp.Acknowledger
+func (self *FakeBroker) Ack(tag uint64, multiple bool) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  if _, ok := self.unacked[tag]; !ok {
+    return fmt.Errorf("unknown delivery tag %d", tag)
+  }
+  delete(self.unacked, tag)
+  self.acked = append(self.acked, tag)
+  return nil
+}
+
+func (self *FakeBroker) Nack(tag uint64, multiple bool, requeue bool) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  d, ok := self.unacked[tag]
+  if !ok {
+    return fmt.Errorf("unknown delivery tag %d", tag)
+  }
+  delete(self.unacked, tag)
+
+  if requeue {
+    d.Redelivered = true
+    self.queue(d.RoutingKey) <- d
+  }
+  return nil
+}
+
+func (self *FakeBroker) Reject(tag uint64, requeue bool) error {
+  return self.Nack(tag, false, requeue)
+}
+
+// Channel of FakeBroker, deliveries not acked when it's closed are requeued
+type fakeChannel struct {
+  broker *FakeBroker
+  mutex sync.Mutex
+  done chan struct{}
+  notify []chan *amqp.Error
+}
+
+func (self *fakeChannel) Qos(prefetch_count, prefetch_size int, global bool) error {
+  return nil
+}
+
+// Deliver one message at a time, next one after the previous is acked
+func (self *fakeChannel) Consume(queue, consumer string, auto_ack, exclusive, no_local, no_wait bool,
+    args amqp.Table) (<-chan amqp.Delivery, error) {
+  self.broker.mutex.Lock()
+  q := self.broker.queue(queue)
+  self.broker.mutex.Unlock()
+
+  out := make(chan amqp.Delivery)
+  go func() {
+    defer close(out)
+    for {
+      select {
+      case <-self.done:
+        return
+      case d := <-q:
+        self.broker.mutex.Lock()
+        self.broker.unacked[d.DeliveryTag] = d
+        self.broker.mutex.Unlock()
+
+        select {
+        case out <- d:
+        case <-self.done:
+          self.broker.Nack(d.DeliveryTag, false, true)
+          return
+        }
+      }
+    }
+  }()
+  return out, nil
+}
+
+func (self *fakeChannel) Publish(exchange, key string, mandatory, immediate bool,
+    msg amqp.Publishing) error {
+  select {
+  case <-self.done:
+    return &amqp.Error{Code: 504, Reason: "channel closed"}
+  default:
+  }
+
+  self.broker.mutex.Lock()
+  defer self.broker.mutex.Unlock()
+  self.broker.published = append(self.broker.published,
+    Published{Exchange: exchange, Key: key, Body: msg.Body})
+  return nil
+}
+
+func (self *fakeChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  self.notify = append(self.notify, c)
+  return c
+}
+
+func (self *fakeChannel) close(err *amqp.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  select {
+  case <-self.done:
+    return
+  default:
+  }
+  close(self.done)
+
+  for _, c := range self.notify {
+    if err != nil {
+      c <- err
+    }
+    close(c)
+  }
+  self.notify = nil
+
+  // unacked deliveries go back to their queues
+  self.broker.mutex.Lock()
+  var tags []uint64
+  for tag := range self.broker.unacked {
+    tags = append(tags, tag)
+  }
+  self.broker.mutex.Unlock()
+  for _, tag := range tags {
+    self.broker.Nack(tag, false, true)
+  }
+}
+
+func (self *fakeChannel) Close() error {
+  self.close(nil)
+  return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+  "flag"
+  "github.com/golang/glog"
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/publisher"
+)
+
+func main() {
+  flag.Parse()
+  glog.Infof("Publisher %s", common.VERSION)
+
+  app, err := publisher.NewPublisher()
+  if err != nil {
+    glog.Fatal(err)
+  }
+
+  if err := app.Start(); err != nil {
+    glog.Error(err)
+  }
+  glog.Flush()
+}
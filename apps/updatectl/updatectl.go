@@ -0,0 +1,214 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "flag"
+  "time"
+  "io/ioutil"
+  "encoding/json"
+  up "github.com/zex/container-update/updater"
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+)
+
+const usage = `usage: updatectl [options] <command> [args]
+
+commands:
+  status                     show containers and last run of daemon
+  history                    show applied manifests from the newest
+  apply <manifest>           apply update manifest file, json or encoded
+  plan <manifest>            show what applying update manifest file would do
+  run                        trigger a pull mode run now
+  activate [id]              switch containers of the staged manifest
+  rollback <component>       set up previous image of component, signed with -key
+  encode <type> <json>       encode asset, sub or update manifest file
+  decode <type> <data>       decode asset, sub or update manifest, file or data,
+                             signed update manifest is shown without verifying
+  verify <manifest> <keys>   verify signed update manifest with PEM public key(s)
+  action <name> [args]       run maintenance action signed with -key, args in json
+
+options:
+`
+
+var (
+  addr = flag.String("addr", up.API_ADDR, "Daemon api address, host:port or unix:<path>")
+  token = flag.String("token", up.API_TOKEN, "Daemon api token, required on host:port")
+  limit = flag.Int("limit", 10, "Max number of history records")
+  key = flag.String("key", "", "PEM private key to sign action request")
+  requester = flag.String("requester", os.Getenv("USER"), "Requester recorded with action")
+  device = flag.String("device", common.DeviceId(), "Device action request is valid on")
+)
+
+func fail(err error) {
+  fmt.Fprintln(os.Stderr, err)
+  os.Exit(1)
+}
+
+func printJson(v interface{}) {
+  data, err := json.MarshalIndent(v, "", "  ")
+  if err != nil { fail(err) }
+  fmt.Println(string(data))
+}
+
+func needArgs(args []string, n int) {
+  if len(args) < n {
+    flag.Usage()
+    os.Exit(2)
+  }
+}
+
+// argument given as file path or data itself
+func readArg(arg string) []byte {
+  if data, err := ioutil.ReadFile(arg); err == nil {
+    return data
+  }
+  return []byte(arg)
+}
+
+func newMani(ty string) interface{} {
+  switch ty {
+  case "asset":
+    return &manifest.AssetManifest{}
+  case "sub":
+    return &manifest.SubManifest{}
+  case "update":
+    return &manifest.UpdateManifest{}
+  }
+  fail(fmt.Errorf("unknown manifest type: %s", ty))
+  return nil
+}
+
+func encode(ty, path string) {
+  mani := newMani(ty)
+  data, err := ioutil.ReadFile(path)
+  if err != nil { fail(err) }
+
+  if err := json.Unmarshal(data, mani); err != nil { fail(err) }
+
+  enc, err := manifest.EncodeManifest(mani)
+  if err != nil { fail(err) }
+  fmt.Println(enc)
+}
+
+func decode(ty, arg string) {
+  mani := newMani(ty)
+  data := string(readArg(arg))
+
+  if ty == "update" {
+    if env, err := manifest.ParseEnvelope([]byte(data)); err == nil {
+      if mani, err = manifest.ParseUpdateMani(env.Payload); err != nil { fail(err) }
+    } else if err := mani.(*manifest.UpdateManifest).Decode(data); err != nil {
+      fail(err)
+    }
+  } else if err := manifest.DecodeMani(mani, data); err != nil {
+    fail(err)
+  }
+  printJson(mani)
+}
+
+func verify(path, keys_path string) {
+  env, err := manifest.ParseEnvelope(readArg(path))
+  if err != nil { fail(err) }
+
+  keys, err := manifest.LoadPublicKeys(keys_path)
+  if err != nil { fail(err) }
+
+  if _, err := env.UpdateManifest(keys); err != nil { fail(err) }
+  fmt.Println("verified")
+}
+
+// Action request sealed with -key
+func newAction(name, args string) *manifest.Envelope {
+  if *key == "" {
+    fail(fmt.Errorf("action request must be signed, see -key"))
+  }
+
+  req := &manifest.ActionRequest{
+    Id: fmt.Sprintf("%s-%d", name, time.Now().UnixNano()),
+    Action: name,
+    Requester: *requester,
+    Device: *device,
+    CreatedAt: time.Now().UTC(),
+  }
+  if args != "" {
+    req.Args = json.RawMessage(readArg(args))
+  }
+
+  signer, err := manifest.LoadPrivateKey(*key)
+  if err != nil { fail(err) }
+
+  env, err := manifest.Seal(signer, manifest.ENVELOPE_ACTION, req)
+  if err != nil { fail(err) }
+  return env
+}
+
+func main() {
+  flag.Usage = func() {
+    fmt.Fprint(os.Stderr, usage)
+    flag.PrintDefaults()
+  }
+  flag.Parse()
+
+  args := flag.Args()
+  needArgs(args, 1)
+  cli := up.NewApiClient(*addr)
+  cli.Token = *token
+
+  switch args[0] {
+  case "status":
+    status, err := cli.Status()
+    if err != nil { fail(err) }
+    printJson(status)
+  case "history":
+    hist, err := cli.History(*limit)
+    if err != nil { fail(err) }
+    printJson(hist)
+  case "apply":
+    needArgs(args, 2)
+    data, err := ioutil.ReadFile(args[1])
+    if err != nil { fail(err) }
+    if err := cli.Apply(data); err != nil { fail(err) }
+    fmt.Println("applied")
+  case "plan":
+    needArgs(args, 2)
+    data, err := ioutil.ReadFile(args[1])
+    if err != nil { fail(err) }
+    plan, err := cli.Plan(data)
+    if err != nil { fail(err) }
+    printJson(plan)
+  case "run":
+    if err := cli.Run(); err != nil { fail(err) }
+    fmt.Println("accepted")
+  case "activate":
+    id := ""
+    if len(args) > 1 { id = args[1] }
+    if err := cli.Activate(id); err != nil { fail(err) }
+    fmt.Println("activated")
+  case "rollback":
+    needArgs(args, 2)
+    comp, err := json.Marshal(&up.CompArgs{Component: args[1]})
+    if err != nil { fail(err) }
+    ret, err := cli.Action(newAction(up.ACTION_ROLLBACK, string(comp)))
+    if err != nil { fail(err) }
+    printJson(ret)
+  case "encode":
+    needArgs(args, 3)
+    encode(args[1], args[2])
+  case "decode":
+    needArgs(args, 3)
+    decode(args[1], args[2])
+  case "verify":
+    needArgs(args, 3)
+    verify(args[1], args[2])
+  case "action":
+    needArgs(args, 2)
+    action_args := ""
+    if len(args) > 2 { action_args = args[2] }
+    ret, err := cli.Action(newAction(args[1], action_args))
+    if err != nil { fail(err) }
+    printJson(ret)
+  default:
+    fail(fmt.Errorf("unknown command: %s, see -h", args[0]))
+  }
+}
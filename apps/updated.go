@@ -12,4 +12,5 @@ func main() {
   glog.Infof("Updater %s", common.VERSION)
   app := up.NewDaemon()
   app.Start()
+  glog.Flush()
 }
@@ -0,0 +1,59 @@
+package common
+
+import (
+  "time"
+  "encoding/json"
+)
+
+type CommandType string
+
+const (
+  CommandApply CommandType = "apply"
+  CommandStatus CommandType = "status"
+  // args of the ones below are signed action requests of the same action
+  CommandRollback CommandType = "rollback"
+  CommandPrune CommandType = "prune"
+  CommandRestartComponent CommandType = "restart-component"
+  CommandCollectLogs CommandType = "collect-logs"
+  // maintenance action, args is a signed action request
+  CommandAction CommandType = "action"
+)
+
+type ReplyState string
+
+const (
+  ReplyAccepted ReplyState = "accepted"
+  ReplyInProgress ReplyState = "in-progress"
+  ReplyResult ReplyState = "result"
+)
+
+// Command sent to updater over message bus
+type Command struct {
+  Id string `json:"id"`
+  Ty CommandType `json:"type"`
+  // arguments specific to command type
+  Args json.RawMessage `json:"args,omitempty"`
+  CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// Reply to command correlated by command id, a command gets accepted,
+// in-progress and result replies in order unless refused on arrival
+type Reply struct {
+  Id string `json:"id"`
+  Ty CommandType `json:"type,omitempty"`
+  State ReplyState `json:"state"`
+  CreatedAt time.Time `json:"created_at,omitempty"`
+  Version string `json:"version,omitempty"`
+  Error string `json:"error,omitempty"`
+  Result json.RawMessage `json:"result,omitempty"`
+}
+
+func NewReply(cmd *Command, state ReplyState) *Reply {
+  return &Reply{
+    Id: cmd.Id,
+    Ty: cmd.Ty,
+    State: state,
+    CreatedAt: time.Now(),
+    Version: VERSION,
+  }
+}
@@ -12,6 +12,13 @@ const (
   EventTypeStarted EventType = "started"
   EventTypeUpdated EventType = "updated"
   EventTypeError EventType = "error"
+  EventTypeRejected EventType = "rejected"
+  EventTypePlan EventType = "plan"
+  EventTypeProgress EventType = "progress"
+  EventTypeStaged EventType = "staged"
+  EventTypeQueued EventType = "queued"
+  EventTypeStopped EventType = "stopped"
+  EventTypeAudit EventType = "audit"
 )
 
 
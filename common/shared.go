@@ -1,12 +1,44 @@
 package common
 
+import (
+  "context"
+)
+
 const (
   TopicUpdateManifest = "update_manifest"
   TopicHeartbeat = "heartbeat"
   TopicEvent = "event"
+  TopicActivate = "activate"
+  TopicStatus = "status"
+  TopicCommand = "command"
+  TopicReply = "reply"
 )
 
 type Publisher interface {
   PublishEvent(data []byte) error
   PublishHeartbeat(data []byte) error
 }
+
+// Receives raw messages from a transport, error is returned if message was
+// not processed, only AMQP delivers such message again, MQTT and STOMP ack
+// messages on arrival
+type MsgHandler interface {
+  Handle(topic string, data []byte) error
+}
+
+// Message bus connection of the updater
+type Transport interface {
+  Publisher
+  // Publish to topic defined in subscription manifest by key
+  Publish(key string, data []byte) error
+  // Announce presence on status topic
+  PublishPresence(p *Presence) error
+  // Topic or queue defined in subscription manifest by key
+  Topic(key string) string
+  // Prepare subscription to update manifest, activate and command topics
+  SubUpdate()
+  // Connect and serve subscriptions until context is done
+  StartSub(ctx context.Context)
+  // Connect once and publish data to each topic, errors by topic
+  PushAll(topics []string, data []byte) (map[string]error, error)
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+  "os"
+  "time"
+  "strings"
+  "strconv"
+  "io/ioutil"
+  "encoding/json"
+)
+
+type PresenceState string
+
+const (
+  PresenceOnline PresenceState = "online"
+  PresenceOffline PresenceState = "offline"
+)
+
+var (
+  startedAt = time.Now()
+)
+
+// Retained on status topic, offline is sent by broker as last will
+type Presence struct {
+  State PresenceState `json:"state"`
+  Version string `json:"version,omitempty"`
+  // host boot time
+  BootTime time.Time `json:"boot_time,omitempty"`
+  // updater start time
+  StartedAt time.Time `json:"started_at,omitempty"`
+  CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+func NewPresence(state PresenceState) *Presence {
+  return &Presence{
+    State: state,
+    Version: VERSION,
+    BootTime: BootTime(),
+    StartedAt: startedAt,
+    CreatedAt: time.Now(),
+  }
+}
+
+func (p *Presence) Encode() []byte {
+  data, _ := json.Marshal(p)
+  return data
+}
+
+// Host boot time from /proc/stat, zero if unknown
+func BootTime() time.Time {
+  data, err := ioutil.ReadFile("/proc/stat")
+  if err != nil { return time.Time{} }
+
+  for _, line := range strings.Split(string(data), "\n") {
+    fields := strings.Fields(line)
+    if len(fields) != 2 || fields[0] != "btime" { continue }
+
+    sec, err := strconv.ParseInt(fields[1], 10, 64)
+    if err != nil { break }
+    return time.Unix(sec, 0)
+  }
+
+  if info, err := os.Stat("/proc/1"); err == nil {
+    return info.ModTime()
+  }
+  return time.Time{}
+}
@@ -225,3 +225,27 @@ func Decompress(data []byte) ([]byte, error) {
 
   return ret.Bytes(), nil
 }
+
+// Read environment variable, fallback to def if not set
+func GetEnvOr(key, def string) string {
+  if val := os.Getenv(key); val != "" {
+    return val
+  }
+  return def
+}
+
+// Device identity from DEVICE_ID, machine id or host name otherwise
+func DeviceId() string {
+  if id := os.Getenv("DEVICE_ID"); id != "" {
+    return id
+  }
+
+  if data, err := ioutil.ReadFile("/etc/machine-id"); err == nil {
+    if id := strings.TrimSpace(string(data)); id != "" {
+      return id
+    }
+  }
+
+  host, _ := os.Hostname()
+  return host
+}
@@ -0,0 +1,20 @@
+package manifest
+
+import (
+  "time"
+  "encoding/json"
+)
+
+// Request to run a whitelisted maintenance action on device, transmitted
+// sealed in an envelope
+type ActionRequest struct {
+  Id string `json:"id"`
+  Action string `json:"action"`
+  // arguments specific to action
+  Args json.RawMessage `json:"args,omitempty"`
+  // who asked for it, recorded in audit events
+  Requester string `json:"requester,omitempty"`
+  // id of the only device the request is valid on
+  Device string `json:"device"`
+  CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,207 @@
+package manifest
+
+import (
+  "fmt"
+  "bytes"
+  "os"
+  "path/filepath"
+  "io/ioutil"
+  "crypto"
+  "crypto/rand"
+  "crypto/ecdsa"
+  "crypto/ed25519"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/hex"
+  "encoding/json"
+  "encoding/pem"
+  "encoding/base64"
+)
+
+// Types of signed payload, signed along with it so that a signature over
+// one kind of message is never accepted for another
+const (
+  ENVELOPE_UPDATE = "update-manifest"
+  ENVELOPE_ACTION = "action-request"
+)
+
+// Signed message as transmitted, signature covers Type and Payload bytes
+// exactly as signed so that no side has to reproduce them, payload is parsed
+// only once it's verified
+type Envelope struct {
+  Type string `json:"type"`
+  // json of update manifest or action request, base64 in json
+  Payload []byte `json:"payload"`
+  Digest string `json:"digest"`
+  Signature string `json:"signature"`
+}
+
+// Sign type and json of v with Ed25519 or ECDSA private key
+func Seal(key crypto.Signer, ty string, v interface{}) (*Envelope, error) {
+  payload, err := json.Marshal(v)
+  if err != nil { return nil, err }
+
+  ret := &Envelope{Type: ty, Payload: payload}
+  if ret.Digest, ret.Signature, err = signBytes(key, ret.signed()); err != nil {
+    return nil, err
+  }
+  return ret, nil
+}
+
+// Bytes covered by digest and signature, type then payload
+func (self *Envelope) signed() []byte {
+  return append([]byte(self.Type + "\n"), self.Payload...)
+}
+
+// Payload if envelope is of type ty and Digest and Signature are verified by
+// any of the keys
+func (self *Envelope) Open(ty string, keys []crypto.PublicKey) ([]byte, error) {
+  if self.Signature == "" || self.Digest == "" {
+    return nil, fmt.Errorf("not signed")
+  }
+
+  if self.Type != ty {
+    return nil, fmt.Errorf("signed %q, not %q", self.Type, ty)
+  }
+
+  if err := verifyBytes(keys, self.signed(), self.Digest, self.Signature); err != nil {
+    return nil, err
+  }
+  return self.Payload, nil
+}
+
+func (self *Envelope) Encode() (string, error) {
+  return EncodeManifest(self)
+}
+
+// Parse envelope given either in json or encoded
+func ParseEnvelope(data []byte) (*Envelope, error) {
+  env := &Envelope{}
+  data = bytes.TrimSpace(data)
+
+  if bytes.HasPrefix(data, []byte("{")) {
+    if err := json.Unmarshal(data, env); err != nil {
+      return nil, err
+    }
+  } else if err := DecodeMani(env, string(data)); err != nil {
+    return nil, err
+  }
+
+  if len(env.Payload) == 0 {
+    return nil, fmt.Errorf("no payload, not signed")
+  }
+  return env, nil
+}
+
+// Update manifest in envelope once verified by any of the keys, digest of
+// envelope identifies the manifest
+func (self *Envelope) UpdateManifest(keys []crypto.PublicKey) (*UpdateManifest, error) {
+  payload, err := self.Open(ENVELOPE_UPDATE, keys)
+  if err != nil { return nil, err }
+
+  mani, err := ParseUpdateMani(payload)
+  if err != nil { return nil, err }
+
+  mani.Digest = self.Digest
+  mani.Envelope = self
+  return mani, nil
+}
+
+// Hex sha256 digest and base64 signature of data
+func signBytes(key crypto.Signer, data []byte) (string, string, error) {
+  digest := sha256.Sum256(data)
+
+  var sig []byte
+  var err error
+  switch key.(type) {
+  case ed25519.PrivateKey:
+    sig, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+  case *ecdsa.PrivateKey:
+    sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+  default:
+    return "", "", fmt.Errorf("unsupported key type: %T", key)
+  }
+  if err != nil { return "", "", err }
+
+  return hex.EncodeToString(digest[:]), base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// Verify hex digest and base64 signature of data, any of the keys will do
+func verifyBytes(keys []crypto.PublicKey, data []byte, digest_hex, sig_b64 string) error {
+  if len(keys) == 0 {
+    return fmt.Errorf("no trusted key")
+  }
+
+  digest := sha256.Sum256(data)
+  if digest_hex != hex.EncodeToString(digest[:]) {
+    return fmt.Errorf("digest mismatch")
+  }
+
+  sig, err := base64.StdEncoding.DecodeString(sig_b64)
+  if err != nil { return err }
+
+  for _, key := range keys {
+    switch pub := key.(type) {
+    case ed25519.PublicKey:
+      if ed25519.Verify(pub, data, sig) { return nil }
+    case *ecdsa.PublicKey:
+      if ecdsa.VerifyASN1(pub, digest[:], sig) { return nil }
+    }
+  }
+
+  return fmt.Errorf("signature not verified by any trusted key")
+}
+
+// Load PEM encoded PKIX public keys from a file or all files in a directory
+func LoadPublicKeys(path string) ([]crypto.PublicKey, error) {
+  files := []string{path}
+
+  info, err := os.Stat(path)
+  if err != nil { return nil, err }
+
+  if info.IsDir() {
+    if files, err = filepath.Glob(filepath.Join(path, "*.pem")); err != nil {
+      return nil, err
+    }
+  }
+
+  var keys []crypto.PublicKey
+  for _, f := range files {
+    data, err := ioutil.ReadFile(f)
+    if err != nil { return nil, err }
+
+    for {
+      var block *pem.Block
+      if block, data = pem.Decode(data); block == nil { break }
+      if block.Type != "PUBLIC KEY" { continue }
+
+      key, err := x509.ParsePKIXPublicKey(block.Bytes)
+      if err != nil {
+        return nil, fmt.Errorf("%s: %v", f, err)
+      }
+      keys = append(keys, key)
+    }
+  }
+
+  return keys, nil
+}
+
+// Load PEM encoded PKCS8 private key
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil { return nil, err }
+
+  block, _ := pem.Decode(data)
+  if block == nil {
+    return nil, fmt.Errorf("%s: no PEM data found", path)
+  }
+
+  key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+  if err != nil { return nil, err }
+
+  signer, ok := key.(crypto.Signer)
+  if !ok {
+    return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+  }
+  return signer, nil
+}
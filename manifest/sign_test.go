@@ -0,0 +1,47 @@
+package manifest
+
+import (
+  "time"
+  "testing"
+  "crypto"
+  "crypto/rand"
+  "crypto/ecdsa"
+  "crypto/ed25519"
+  "crypto/elliptic"
+)
+
+func TestEnvelopeType(t *testing.T) {
+  ed_pub, ed_priv, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil { t.Fatal(err) }
+  ec_priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil { t.Fatal(err) }
+
+  mani := &UpdateManifest{CreatedAt: time.Now().UTC()}
+  signers := map[string]crypto.Signer{"ed25519": ed_priv, "ecdsa": ec_priv}
+  keys := map[string]crypto.PublicKey{"ed25519": ed_pub, "ecdsa": &ec_priv.PublicKey}
+
+  for name, key := range signers {
+    trusted := []crypto.PublicKey{keys[name]}
+
+    env, err := Seal(key, ENVELOPE_UPDATE, mani)
+    if err != nil { t.Fatal(err) }
+    if _, err := env.UpdateManifest(trusted); err != nil {
+      t.Errorf("%s: update manifest refused: %v", name, err)
+    }
+    if _, err := env.Open(ENVELOPE_ACTION, trusted); err == nil {
+      t.Errorf("%s: update manifest opened as action request", name)
+    }
+
+    // type is covered by signature
+    env.Type = ENVELOPE_ACTION
+    if _, err := env.Open(ENVELOPE_ACTION, trusted); err == nil {
+      t.Errorf("%s: retyped envelope opened", name)
+    }
+
+    env, err = Seal(key, ENVELOPE_ACTION, &ActionRequest{Id: "1"})
+    if err != nil { t.Fatal(err) }
+    if _, err := env.UpdateManifest(trusted); err == nil {
+      t.Errorf("%s: action request opened as update manifest", name)
+    }
+  }
+}
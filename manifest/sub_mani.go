@@ -11,6 +11,11 @@ type SubManifest struct {
   Cred Credential `json:"cred,omitempty"`
   Queues map[string]string `json:"queues,omitempty"`
   Topics map[string]string `json:"topics,omitempty"`
+  // used with ssl:// and wss:// brokers
+  Tls *TlsConfig `json:"tls,omitempty"`
+  // AMQP exchange events and heartbeats are published to, topics are
+  // used as routing keys
+  Exchange string `json:"exchange,omitempty"`
 }
 
 func (self *SubManifest) Decode(data string) error {
@@ -0,0 +1,89 @@
+package manifest
+
+import (
+  "fmt"
+  "strings"
+  "io/ioutil"
+  "crypto/tls"
+  "crypto/x509"
+)
+
+// TLS settings of broker connection, each PEM is either embedded or a path
+// to a file holding it
+type TlsConfig struct {
+  // CA bundle to verify broker with, system roots if empty
+  Ca string `json:"ca,omitempty"`
+  // client certificate and key for mutual TLS
+  Cert string `json:"cert,omitempty"`
+  Key string `json:"key,omitempty"`
+  // overrides host name in uri on verification
+  ServerName string `json:"server_name,omitempty"`
+  // skip broker verification, for labs only
+  InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+func isPem(s string) bool {
+  return strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN")
+}
+
+// Embedded PEM or content of file it refers to
+func readPem(s string) ([]byte, error) {
+  if isPem(s) {
+    return []byte(s), nil
+  }
+  return ioutil.ReadFile(s)
+}
+
+// Embed PEM files referenced into config
+func (self *TlsConfig) Embed() error {
+  for _, s := range []*string{&self.Ca, &self.Cert, &self.Key} {
+    if *s == "" || isPem(*s) { continue }
+
+    data, err := ioutil.ReadFile(*s)
+    if err != nil { return err }
+    *s = string(data)
+  }
+  return nil
+}
+
+func (self *TlsConfig) Config() (*tls.Config, error) {
+  ret := &tls.Config{
+    ServerName: self.ServerName,
+    InsecureSkipVerify: self.InsecureSkipVerify,
+  }
+
+  if self.Ca != "" {
+    data, err := readPem(self.Ca)
+    if err != nil {
+      return nil, fmt.Errorf("failed to read ca: %v", err)
+    }
+
+    ret.RootCAs = x509.NewCertPool()
+    if !ret.RootCAs.AppendCertsFromPEM(data) {
+      return nil, fmt.Errorf("no certificate found in ca")
+    }
+  }
+
+  if (self.Cert == "") != (self.Key == "") {
+    return nil, fmt.Errorf("client cert and key must be given together")
+  }
+
+  if self.Cert != "" {
+    cert, err := readPem(self.Cert)
+    if err != nil {
+      return nil, fmt.Errorf("failed to read client cert: %v", err)
+    }
+
+    key, err := readPem(self.Key)
+    if err != nil {
+      return nil, fmt.Errorf("failed to read client key: %v", err)
+    }
+
+    pair, err := tls.X509KeyPair(cert, key)
+    if err != nil {
+      return nil, fmt.Errorf("invalid client cert: %v", err)
+    }
+    ret.Certificates = []tls.Certificate{pair}
+  }
+  return ret, nil
+}
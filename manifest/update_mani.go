@@ -10,6 +10,9 @@ import (
   "github.com/andelf/go-curl"
   "github.com/golang/glog"
   "bytes"
+  "regexp"
+  "strings"
+  "encoding/json"
   //"strconv"
   "github.com/docker/docker/api/types/container"
   "github.com/docker/docker/api/types/network"
@@ -24,6 +27,21 @@ const (
   // The component need to be deprecated
   COMPOP_DEPRECATE
 )
+// Readiness probe of a component, one of Http, Tcp or Exec is performed,
+// Docker HEALTHCHECK is waited for with Timeout, Interval and Retries if none
+type Health struct {
+  // url to GET, any status below 400 counts as ready
+  Http string `json:"http,omitempty"`
+  // host:port to connect
+  Tcp string `json:"tcp,omitempty"`
+  // command executed inside container, exit code 0 counts as ready
+  Exec []string `json:"exec,omitempty"`
+  // timeout of each attempt, time.ParseDuration format
+  Timeout string `json:"timeout,omitempty"`
+  // time between attempts, time.ParseDuration format
+  Interval string `json:"interval,omitempty"`
+  Retries int `json:"retries,omitempty"`
+}
 // Component definition, including informantion like what to run and how to run
 type Component struct {
   Version string `json:"version"`
@@ -31,6 +49,8 @@ type Component struct {
   Registry string `json:"registry"`
   ImageName string `json:"image_name"`
   ImageTag string `json:"image_tag"`
+  // sha256:<hex> of image manifest, image is pulled and run by digest if given
+  ImageDigest string `json:"image_digest,omitempty"`
   ContainerConfig container.Config `json:"container_config,omitempty"`
   HostConfig container.HostConfig `json:"host_config,omitempty"`
   NetConfig network.NetworkingConfig `json:"net_config,omitempty"`
@@ -38,15 +58,45 @@ type Component struct {
   Op UpdateOp `json:"op,omitempty"`
   Force bool `json:"force,omitempty"`
   Cred string `json:"cred,omitempty"`
+  Health *Health `json:"health,omitempty"`
+  // names of components to be set up before this one
+  DependsOn []string `json:"depends_on,omitempty"`
+  // apply even if manifest is not newer than the last applied one
+  AllowDowngrade bool `json:"allow_downgrade,omitempty"`
+  // apply outside maintenance window
+  Urgent bool `json:"urgent,omitempty"`
+}
+// Recurring time range updates are applied in
+type MaintWindow struct {
+  // standard cron expression of window opening, e.g. "0 2 * * *"
+  Cron string `json:"cron"`
+  // how long window stays open, time.ParseDuration format
+  Duration string `json:"duration"`
+  // IANA time zone name, local time if empty
+  Timezone string `json:"timezone,omitempty"`
 }
 // Component details for update
 type UpdateManifest struct {
-  Signature string `json:"signature,omitempty"`
-  Digest string `json:"digest,omitempty"`
+  // digest of envelope manifest came in, set once verified
+  Digest string `json:"-"`
+  // signed manifest as received, kept to be verified again on reload
+  Envelope *Envelope `json:"-"`
   CreatedAt time.Time `json:"created_at,omitempty"`
   Components []Component `json:"components"`
+  // only report what would be done without applying
+  PlanOnly bool `json:"plan_only,omitempty"`
+  // images are pulled right away, containers are switched at this time
+  ActivateAt time.Time `json:"activate_at,omitempty"`
+  // images are pulled right away, containers are switched on activate command
+  WaitActivate bool `json:"wait_activate,omitempty"`
+  // overrides maintenance window of updater
+  Window *MaintWindow `json:"window,omitempty"`
 }
 
+var (
+  digestPattern = regexp.MustCompile("^sha256:[a-f0-9]{64}$")
+)
+
 // names of known components
 const (
   COMP_UPDATER = "updater"
@@ -57,7 +107,116 @@ func (self *UpdateManifest) Encode() (string, error) {
 }
 
 func (self *UpdateManifest) Decode(data string) error {
-  return DecodeMani(self, data)
+  if err := DecodeMani(self, data); err != nil {
+    return err
+  }
+  return self.Validate()
+}
+
+// Images are staged and containers switched in a later phase
+func (self *UpdateManifest) TwoPhase() bool {
+  return self.WaitActivate || !self.ActivateAt.IsZero()
+}
+
+// Identify manifest by digest if signed, by creation time otherwise
+func (self *UpdateManifest) Id() string {
+  if self.Digest != "" {
+    return self.Digest
+  }
+  return self.CreatedAt.Format(time.RFC3339Nano)
+}
+
+// Parse update manifest given either in json or encoded
+func ParseUpdateMani(data []byte) (*UpdateManifest, error) {
+  mani := &UpdateManifest{}
+  data = bytes.TrimSpace(data)
+
+  if bytes.HasPrefix(data, []byte("{")) {
+    if err := json.Unmarshal(data, mani); err != nil {
+      return nil, err
+    }
+    return mani, mani.Validate()
+  }
+
+  if err := mani.Decode(string(data)); err != nil {
+    return nil, err
+  }
+  return mani, nil
+}
+
+// Image reference to pull and run, pinned by digest if ImageDigest given
+func (self *Component) ImageRef() string {
+  if self.ImageDigest == "" {
+    return self.ContainerConfig.Image
+  }
+  return fmt.Sprintf("%s@%s", self.ImageRepo(), self.ImageDigest)
+}
+
+// Image reference without tag or digest
+func (self *Component) ImageRepo() string {
+  if self.Registry != "" && self.ImageName != "" {
+    return fmt.Sprintf("%s/%s", self.Registry, self.ImageName)
+  }
+
+  repo := self.ContainerConfig.Image
+  if i := strings.Index(repo, "@"); i >= 0 {
+    repo = repo[:i]
+  }
+  if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+    repo = repo[:i]
+  }
+  return repo
+}
+
+// Check component names are unique, image digests are well formed and
+// dependencies are known and acyclic
+func (self *UpdateManifest) Validate() error {
+  deps := make(map[string][]string)
+  for _, comp := range self.Components {
+    if _, ok := deps[comp.Name]; ok {
+      return fmt.Errorf("duplicate component: %s", comp.Name)
+    }
+    if comp.ImageDigest != "" && !digestPattern.MatchString(comp.ImageDigest) {
+      return fmt.Errorf("%s: invalid image digest: %s", comp.Name, comp.ImageDigest)
+    }
+    deps[comp.Name] = comp.DependsOn
+  }
+
+  for name, dep := range deps {
+    for _, d := range dep {
+      if _, ok := deps[d]; !ok {
+        return fmt.Errorf("%s depends on unknown component: %s", name, d)
+      }
+    }
+  }
+
+  // 1: visiting, 2: visited
+  state := make(map[string]int)
+  var visit func(name string) error
+  visit = func(name string) error {
+    switch state[name] {
+    case 1:
+      return fmt.Errorf("dependency cycle detected at component: %s", name)
+    case 2:
+      return nil
+    }
+
+    state[name] = 1
+    for _, d := range deps[name] {
+      if err := visit(d); err != nil {
+        return err
+      }
+    }
+    state[name] = 2
+    return nil
+  }
+
+  for _, comp := range self.Components {
+    if err := visit(comp.Name); err != nil {
+      return err
+    }
+  }
+  return nil
 }
 
 func (self *UpdateManifest) Generate(out_path string) error {
@@ -99,7 +258,8 @@ func (self *UpdateManifest) post(target url.URL, data []byte) error {
   return fmt.Errorf("post failed: %v", rsp.Status)
 }
 
-func FetchUpdateMani(target string) (*UpdateManifest, error) {
+// Fetch signed update manifest, to be opened with trusted keys
+func FetchUpdateMani(target string) (*Envelope, error) {
   url, err := url.Parse(target)
   if err != nil {
     return nil, err
@@ -115,12 +275,17 @@ func FetchUpdateMani(target string) (*UpdateManifest, error) {
   return nil, fmt.Errorf("Unsupported scheme")
 }
 
-func fetchFTP(url *url.URL) (*UpdateManifest, error) {
+func fetchFTP(url *url.URL) (*Envelope, error) {
   mani_path, err := fetchFtp(url)
   if err != nil {
     return nil, err
   }
-  return DecodeFromFile(mani_path)
+
+  data, err := ioutil.ReadFile(mani_path)
+  if err != nil {
+    return nil, err
+  }
+  return ParseEnvelope(data)
 }
 
 func fetchFtp(url *url.URL) (string, error) {
@@ -173,7 +338,7 @@ func DecodeFromFile(mani_path string) (*UpdateManifest, error) {
   return mani, nil
 }
 
-func fetchRest(url *url.URL) (*UpdateManifest, error) {
+func fetchRest(url *url.URL) (*Envelope, error) {
   rsp, err := http.Get(url.String())
   if err != nil {
     return nil, err
@@ -181,7 +346,7 @@ func fetchRest(url *url.URL) (*UpdateManifest, error) {
   defer rsp.Body.Close()
 
   if rsp.StatusCode != http.StatusOK {
-    return nil, fmt.Errorf("fetch update manifest failed: ", rsp.Status)
+    return nil, fmt.Errorf("fetch update manifest failed: %s", rsp.Status)
   }
 
   buf, err := ioutil.ReadAll(rsp.Body)
@@ -191,10 +356,5 @@ func fetchRest(url *url.URL) (*UpdateManifest, error) {
 
   // data, _ := strconv.Unquote(buf)
 
-  mani := &UpdateManifest{}
-  if err := mani.Decode(string(buf)); err != nil {
-    return nil, err
-  }
-
-  return mani, nil
+  return ParseEnvelope(buf)
 }
@@ -1,9 +1,11 @@
 package mqtt
 
 import (
-  "os"
   "time"
+  "sync"
+  "context"
   "fmt"
+  "strings"
   "github.com/golang/glog"
   "github.com/eclipse/paho.mqtt.golang"
 
@@ -14,56 +16,210 @@ import (
 var (
   Qos = byte(1)
   ConnectTimeout = "10s"
+  // time to wait for broker to acknowledge a message
+  PublishTimeout = common.GetEnvOr("MQTT_PUBLISH_TIMEOUT", "10s")
+  // max wait between connect attempts, doubled from one second on failure
+  ReconnectMax = common.GetEnvOr("MQTT_RECONNECT_MAX", "2m")
+  // time in milliseconds to let pending work finish on disconnect
+  DisconnectQuiesce = uint(250)
+  // messages of a topic waiting for handler before client is held back
+  InboxSize = 64
 )
 
-type MsgHandler interface {
-  Handle(msg mqtt.Message)
-}
-
 type Sub struct {
-  MsgHandler
+  common.MsgHandler
   cli mqtt.Client
   opt *mqtt.ClientOptions
+  // options not usable, never connected
+  opt_err error
   mani *manifest.SubManifest
+  // messages kept while broker is away, nil if unavailable
+  outbox *Outbox
+  // received messages by topic, each handled by a worker of its own
+  inbox_mutex sync.Mutex
+  inboxes map[string]chan mqtt.Message
 }
 
-func NewSub(h MsgHandler) *Sub {
-  ret := Sub{ MsgHandler: h}
-  mani, err := manifest.LoadSubMani()
-  if err != nil {
-    panic(fmt.Sprintf("load subscribe manifest failed: %v", err))
-  }
-  ret.mani = mani
-  return &ret
+func NewSub(h common.MsgHandler, mani *manifest.SubManifest) *Sub {
+  return &Sub{ MsgHandler: h, mani: mani }
 }
 
-func (s *Sub) StartSub() {
+// Connect and serve subscriptions until context is done
+func (s *Sub) StartSub(ctx context.Context) {
   glog.Infof("%s", common.CurrentScope())
-  s.run()
+  s.run(ctx)
 }
 
+// Pass message to worker of its topic, client's router is not held while a
+// manifest is applied and commands keep coming in meanwhile
 func (s *Sub) messageHandler(cli mqtt.Client, msg mqtt.Message) {
-  glog.Infof("%s", common.CurrentScope())
-  s.MsgHandler.Handle(msg)
+  glog.Infof("%s (%s)", common.CurrentScope(), msg.Topic())
+  s.inbox(msg.Topic()) <- msg
+}
+
+func (s *Sub) inbox(topic string) chan mqtt.Message {
+  s.inbox_mutex.Lock()
+  defer s.inbox_mutex.Unlock()
+
+  if s.inboxes == nil {
+    s.inboxes = make(map[string]chan mqtt.Message)
+  }
+
+  ch, ok := s.inboxes[topic]
+  if !ok {
+    ch = make(chan mqtt.Message, InboxSize)
+    s.inboxes[topic] = ch
+    go s.work(ch)
+  }
+  return ch
+}
+
+// Handle messages of one topic in order, message is acked on arrival so
+// it's not delivered again if not processed
+func (s *Sub) work(ch <-chan mqtt.Message) {
+  for msg := range ch {
+    if err := s.MsgHandler.Handle(msg.Topic(), msg.Payload()); err != nil {
+      glog.Errorf("message on %s not processed: %v", msg.Topic(), err)
+    }
+  }
 }
 
-func newClientOptions(mani *manifest.SubManifest) (*mqtt.ClientOptions) {
+// Let workers finish once no more messages come in
+func (s *Sub) closeInboxes() {
+  s.inbox_mutex.Lock()
+  defer s.inbox_mutex.Unlock()
+
+  for _, ch := range s.inboxes {
+    close(ch)
+  }
+  s.inboxes = nil
+}
+
+// Broker uri as understood by client, mqtt:// and mqtts:// are aliases of
+// tcp:// and ssl://
+func brokerUri(uri string) string {
+  if strings.HasPrefix(uri, "mqtt://") {
+    return "tcp://" + strings.TrimPrefix(uri, "mqtt://")
+  }
+  if strings.HasPrefix(uri, "mqtts://") {
+    return "ssl://" + strings.TrimPrefix(uri, "mqtts://")
+  }
+  return uri
+}
+
+func isTlsUri(uri string) bool {
+  uri = brokerUri(uri)
+  for _, scheme := range []string{"ssl://", "tls://", "tcps://", "wss://"} {
+    if strings.HasPrefix(uri, scheme) { return true }
+  }
+  return false
+}
+
+// Options of broker in manifest, error if tls config is given but not usable
+func newClientOptions(mani *manifest.SubManifest) (*mqtt.ClientOptions, error) {
   glog.Infof("%s uri: %s", common.CurrentScope(), mani.Uri)
-  return mqtt.NewClientOptions().AddBroker(mani.Uri).
+  opt := mqtt.NewClientOptions().AddBroker(brokerUri(mani.Uri)).
     SetUsername(mani.Cred.User).
     SetPassword(mani.Cred.Pass)
+
+  if mani.Tls == nil || !isTlsUri(mani.Uri) {
+    return opt, nil
+  }
+
+  // no fallback to default tls config
+  cfg, err := mani.Tls.Config()
+  if err != nil {
+    return opt, fmt.Errorf("invalid tls config: %v", err)
+  }
+
+  if cfg.InsecureSkipVerify {
+    glog.Warning("broker certificate not verified")
+  }
+  return opt.SetTLSConfig(cfg), nil
+}
+
+func parseDuration(s string, def time.Duration) time.Duration {
+  d, err := time.ParseDuration(s)
+  if err != nil {
+    glog.Errorf("invalid duration %s, use %v: %v", s, def, err)
+    return def
+  }
+  return d
+}
+
+// Options of a device client, broker keeps subscriptions and messages of the
+// stable client id while device is away, broker announces device offline on
+// status topic if connection drops
+func newDeviceClientOptions(mani *manifest.SubManifest) (*mqtt.ClientOptions, error) {
+  opt, err := newClientOptions(mani)
+  opt.SetClientID(fmt.Sprintf("updated-%s", common.DeviceId())).
+    SetCleanSession(false).
+    SetAutoReconnect(true).
+    SetMaxReconnectInterval(parseDuration(ReconnectMax, 2 * time.Minute)).
+    SetConnectionLostHandler(func(c mqtt.Client, err error) {
+      glog.Errorf("connection lost, reconnecting: %v", err)
+    })
+
+  if topic := mani.Topics[common.TopicStatus]; topic != "" {
+    opt.SetBinaryWill(topic, common.NewPresence(common.PresenceOffline).Encode(), Qos, true)
+  }
+  return opt, err
 }
 
+// Subscribe to topics until done or connection is lost
+func (s *Sub) subscribe(topics map[string]byte) {
+  backoff, max := time.Second, parseDuration(ReconnectMax, 2 * time.Minute)
+  for s.cli.IsConnectionOpen() {
+    token := s.cli.SubscribeMultiple(topics, s.messageHandler)
+    if token.Wait() && token.Error() == nil {
+      glog.Infof("subscribed to %d topic(s)", len(topics))
+      return
+    }
+
+    glog.Errorf("subscribe failed, retry in %v: %v", backoff, token.Error())
+    time.Sleep(backoff)
+    if backoff *= 2; backoff > max {
+      backoff = max
+    }
+  }
+}
+
+// Called on every (re)connect
+func (s *Sub) onConnect(topics map[string]byte) mqtt.OnConnectHandler {
+  return func(c mqtt.Client) {
+    glog.Infof("connected to %s", s.mani.Uri)
+    s.subscribe(topics)
+    s.pubPresence(common.PresenceOnline)
+    s.flushOutbox()
+  }
+}
+
+// Prepare device subscription, outbox is only kept by subscribed devices
 func (s *Sub) SubUpdate() {
   glog.Infof("%s topic: %s", common.CurrentScope(),
     s.mani.Topics[common.TopicUpdateManifest])
 
-  s.opt = newClientOptions(s.mani).SetOnConnectHandler(func(c mqtt.Client) {
-    if token := s.cli.Subscribe(
-      s.mani.Topics[common.TopicUpdateManifest], Qos, s.messageHandler);
-      token.Wait() && token.Error() != nil {
-      panic(token.Error())
-  }})
+  var err error
+  if s.outbox, err = NewOutbox(OUTBOX_ROOT); err != nil {
+    glog.Errorf("outbox disabled: %v", err)
+  }
+
+  topics := map[string]byte{
+    s.mani.Topics[common.TopicUpdateManifest]: Qos,
+  }
+  for _, key := range []string{common.TopicActivate, common.TopicCommand} {
+    if topic := s.Topic(key); topic != "" {
+      topics[topic] = Qos
+    }
+  }
+
+  s.opt, s.opt_err = newDeviceClientOptions(s.mani)
+  s.opt.SetOnConnectHandler(s.onConnect(topics))
+}
+
+// Topic defined in subscription manifest by key
+func (s *Sub) Topic(key string) string {
+  return s.mani.Topics[key]
 }
 
 func (s *Sub) SetOptions() {
@@ -71,29 +227,65 @@ func (s *Sub) SetOptions() {
     fmt.Sprintf("%s/+", common.TopicHeartbeat): Qos,
     fmt.Sprintf("%s/+", common.TopicEvent): Qos,
   }
-  s.opt = newClientOptions(s.mani).SetOnConnectHandler(func(c mqtt.Client) {
-    if token := s.cli.SubscribeMultiple(topics, s.messageHandler);
-      token.Wait() && token.Error() != nil {
-      panic(token.Error())
-    }})
+  s.opt, s.opt_err = newClientOptions(s.mani)
+  s.opt.SetAutoReconnect(true).
+    SetOnConnectHandler(s.onConnect(topics))
 }
 
-func (s *Sub) run() {
-  s.cli = mqtt.NewClient(s.opt)
+// Connect with backoff until connected or context is done, client reconnects
+// by itself afterwards
+func (s *Sub) connect(ctx context.Context) bool {
+  backoff, max := time.Second, parseDuration(ReconnectMax, 2 * time.Minute)
+  timeout := parseDuration(ConnectTimeout, 10 * time.Second)
+
+  for {
+    token := s.cli.Connect()
+    if token.WaitTimeout(timeout) && token.Error() == nil {
+      return true
+    }
 
-  if token := s.cli.Connect(); token.Wait() && token.Error() != nil {
-    panic(token.Error())
+    err := token.Error()
+    if err == nil {
+      err = fmt.Errorf("timed out")
+    }
+    glog.Errorf("connect to %s failed, retry in %v: %v", s.mani.Uri, backoff, err)
+
+    select {
+    case <-ctx.Done():
+      return false
+    case <-time.After(backoff):
+    }
+    if backoff *= 2; backoff > max {
+      backoff = max
+    }
   }
+}
 
-  c := make(chan os.Signal, 1)
-  <-c
+func (s *Sub) run(ctx context.Context) {
+  if s.opt_err != nil {
+    glog.Errorf("not connecting to %s: %v", s.mani.Uri, s.opt_err)
+    return
+  }
+  s.cli = mqtt.NewClient(s.opt)
+
+  if !s.connect(ctx) { return }
+
+  <-ctx.Done()
+  glog.Infof("disconnecting from %s", s.mani.Uri)
+  // will is not sent on clean disconnect
+  s.pubPresence(common.PresenceOffline)
+  s.cli.Disconnect(DisconnectQuiesce)
+  s.closeInboxes()
 }
 
 /** Publish update on manifest generation */
 func (s *Sub) PubUpdate(mani *manifest.SubManifest, mani_bytes []byte) error {
   glog.Infof("%s topic: %s", common.CurrentScope(), mani.Topics[common.TopicUpdateManifest])
 
-  s.cli = mqtt.NewClient(newClientOptions(mani))
+  opt, err := newClientOptions(mani)
+  if err != nil { return err }
+
+  s.cli = mqtt.NewClient(opt)
   d, _ := time.ParseDuration(ConnectTimeout)
   if token := s.cli.Connect(); token.WaitTimeout(d) && token.Error() != nil {
     return token.Error()
@@ -108,22 +300,97 @@ func (s *Sub) PubUpdate(mani *manifest.SubManifest, mani_bytes []byte) error {
   return nil
 }
 
-func (s *Sub) PublishHeartbeat(data []byte) error {
-  glog.Infof("%s topic: %s", common.CurrentScope(), s.mani.Topics[common.TopicHeartbeat])
-  if token := s.cli.Publish(s.mani.Topics[common.TopicHeartbeat], Qos, false, data);
-    token.Wait() && token.Error() != nil {
-    return token.Error()
+// Connect once and publish data to each topic, used by publisher
+func (s *Sub) PushAll(topics []string, data []byte) (map[string]error, error) {
+  glog.Infof("%s (%d topic(s))", common.CurrentScope(), len(topics))
+
+  opt, err := newClientOptions(s.mani)
+  if err != nil { return nil, err }
+
+  s.cli = mqtt.NewClient(opt)
+  token := s.cli.Connect()
+  if !token.WaitTimeout(parseDuration(ConnectTimeout, 10 * time.Second)) {
+    return nil, fmt.Errorf("connect to %s timed out", s.mani.Uri)
   }
+  if token.Error() != nil {
+    return nil, token.Error()
+  }
+  defer s.cli.Disconnect(DisconnectQuiesce)
 
-  return nil
+  errs := make(map[string]error)
+  for _, topic := range topics {
+    if err := s.publishNow(topic, data); err != nil {
+      errs[topic] = err
+    }
+  }
+  return errs, nil
 }
 
-func (s *Sub) PublishEvent(data []byte) error {
-  glog.Infof("%s topic: %s", common.CurrentScope(), s.mani.Topics[common.TopicEvent])
-  if token := s.cli.Publish(s.mani.Topics[common.TopicEvent], Qos, false, data);
-    token.Wait() && token.Error() != nil {
-    return token.Error()
+// Publish to broker, give up after PublishTimeout
+func (s *Sub) publishNow(topic string, data []byte) error {
+  return s.publishTimeout(topic, false, data)
+}
+
+func (s *Sub) publishTimeout(topic string, retained bool, data []byte) error {
+  // not connected in sched mode, while reconnecting or after disconnect
+  if s.cli == nil || !s.cli.IsConnectionOpen() {
+    return fmt.Errorf("not connected")
   }
 
-  return nil
+  token := s.cli.Publish(topic, Qos, retained, data)
+  if !token.WaitTimeout(parseDuration(PublishTimeout, 10 * time.Second)) {
+    return fmt.Errorf("publish to %s timed out", topic)
+  }
+  return token.Error()
+}
+
+// Publish or keep message in outbox until connection comes back, no outbox
+// in sched mode as there is no connection to come back
+func (s *Sub) publish(topic string, data []byte) error {
+  if s.outbox == nil || s.opt == nil {
+    return s.publishNow(topic, data)
+  }
+  return s.outbox.Publish(topic, data, s.publishNow)
+}
+
+// Retained presence on status topic, never queued as it's stale once
+// connection comes back
+func (s *Sub) PublishPresence(p *common.Presence) error {
+  topic := s.Topic(common.TopicStatus)
+  if topic == "" { return nil }
+
+  glog.Infof("%s topic: %s (%s)", common.CurrentScope(), topic, p.State)
+  return s.publishTimeout(topic, true, p.Encode())
+}
+
+func (s *Sub) pubPresence(state common.PresenceState) {
+  if err := s.PublishPresence(common.NewPresence(state)); err != nil {
+    glog.Errorf("failed to publish presence: %v", err)
+  }
+}
+
+func (s *Sub) flushOutbox() {
+  if s.outbox == nil { return }
+
+  if err := s.outbox.Flush(s.publishNow); err != nil {
+    glog.Errorf("outbox flush stopped: %v", err)
+  }
+}
+
+func (s *Sub) Publish(key string, data []byte) error {
+  glog.Infof("%s topic: %s", common.CurrentScope(), s.Topic(key))
+  if s.Topic(key) == "" {
+    return fmt.Errorf("topic %s not defined", key)
+  }
+  return s.publish(s.Topic(key), data)
+}
+
+func (s *Sub) PublishHeartbeat(data []byte) error {
+  glog.Infof("%s topic: %s", common.CurrentScope(), s.mani.Topics[common.TopicHeartbeat])
+  return s.publish(s.mani.Topics[common.TopicHeartbeat], data)
+}
+
+func (s *Sub) PublishEvent(data []byte) error {
+  glog.Infof("%s topic: %s", common.CurrentScope(), s.mani.Topics[common.TopicEvent])
+  return s.publish(s.mani.Topics[common.TopicEvent], data)
 }
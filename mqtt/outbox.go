@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "sync"
+  "strconv"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "github.com/golang/glog"
+
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/state"
+)
+
+var (
+  // messages published while broker is away
+  OUTBOX_ROOT = common.GetEnvOr("OUTBOX_ROOT", filepath.Join(state.STATE_ROOT, "outbox"))
+  // max number of messages kept, oldest dropped first
+  OUTBOX_MAX = common.GetEnvOr("OUTBOX_MAX", "1000")
+)
+
+type outMsg struct {
+  Topic string `json:"topic"`
+  Payload []byte `json:"payload"`
+}
+
+// Bounded on-disk queue of messages, one file per message named by sequence
+// number so that lexical order is publishing order
+type Outbox struct {
+  mutex *sync.Mutex
+  root string
+  max int
+  // sequence number of the last message queued, continued after restart
+  seq int64
+}
+
+func NewOutbox(root string) (*Outbox, error) {
+  max, err := strconv.Atoi(OUTBOX_MAX)
+  if err != nil {
+    return nil, fmt.Errorf("invalid OUTBOX_MAX: %v", err)
+  }
+
+  if err := os.MkdirAll(root, 0700); err != nil {
+    return nil, err
+  }
+
+  ret := &Outbox{mutex: &sync.Mutex{}, root: root, max: max}
+  names, err := ret.names()
+  if err != nil { return nil, err }
+  if len(names) > 0 {
+    ret.seq = seqOf(names[len(names) - 1])
+  }
+  return ret, nil
+}
+
+// Sequence number message file is named by, 0 if not one
+func seqOf(name string) int64 {
+  name = strings.TrimSuffix(name, ".json")
+  if i := strings.Index(name, "-"); i >= 0 {
+    name = name[:i]
+  }
+  seq, err := strconv.ParseInt(name, 10, 64)
+  if err != nil { return 0 }
+  return seq
+}
+
+func (self *Outbox) names() ([]string, error) {
+  infos, err := ioutil.ReadDir(self.root)
+  if err != nil { return nil, err }
+
+  var ret []string
+  for _, info := range infos {
+    if filepath.Ext(info.Name()) == ".json" {
+      ret = append(ret, info.Name())
+    }
+  }
+  sort.Strings(ret)
+  return ret, nil
+}
+
+// Publish message right away unless older ones are still queued, queue it
+// behind them otherwise so that messages go out in order
+func (self *Outbox) Publish(topic string, payload []byte,
+  publish func(topic string, payload []byte) error) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  names, err := self.names()
+  if err != nil { return err }
+
+  if len(names) == 0 {
+    err := publish(topic, payload)
+    if err == nil { return nil }
+    glog.Infof("%v, keep message to %s in outbox", err, topic)
+    return self.put(topic, payload)
+  }
+
+  if err := self.put(topic, payload); err != nil { return err }
+  if err := self.flush(publish); err != nil {
+    glog.Infof("%v, message to %s kept in outbox", err, topic)
+  }
+  return nil
+}
+
+// Queue message, drop the oldest ones beyond max
+func (self *Outbox) Put(topic string, payload []byte) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.put(topic, payload)
+}
+
+func (self *Outbox) put(topic string, payload []byte) error {
+  data, err := json.Marshal(outMsg{Topic: topic, Payload: payload})
+  if err != nil { return err }
+
+  self.seq++
+  name := fmt.Sprintf("%020d.json", self.seq)
+  tmp := filepath.Join(self.root, name + ".tmp")
+  if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+    return err
+  }
+  if err := os.Rename(tmp, filepath.Join(self.root, name)); err != nil {
+    return err
+  }
+
+  names, err := self.names()
+  if err != nil { return err }
+  for len(names) > self.max {
+    glog.Infof("outbox full, drop %s", names[0])
+    os.RemoveAll(filepath.Join(self.root, names[0]))
+    names = names[1:]
+  }
+  return nil
+}
+
+// Publish queued messages in order, stop at the first failure
+func (self *Outbox) Flush(publish func(topic string, payload []byte) error) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.flush(publish)
+}
+
+func (self *Outbox) flush(publish func(topic string, payload []byte) error) error {
+  names, err := self.names()
+  if err != nil { return err }
+  if len(names) > 0 {
+    glog.Infof("flush %d message(s) from outbox", len(names))
+  }
+
+  for _, name := range names {
+    path := filepath.Join(self.root, name)
+    data, err := ioutil.ReadFile(path)
+    if err != nil { return err }
+
+    var msg outMsg
+    if err := json.Unmarshal(data, &msg); err != nil {
+      glog.Errorf("drop corrupted %s: %v", name, err)
+      os.RemoveAll(path)
+      continue
+    }
+
+    if err := publish(msg.Topic, msg.Payload); err != nil {
+      return err
+    }
+    os.RemoveAll(path)
+  }
+  return nil
+}
@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+  "os"
+  "errors"
+  "testing"
+  "io/ioutil"
+)
+
+// Publisher recording messages, failing while down
+type recorder struct {
+  down bool
+  sent []string
+}
+
+func (self *recorder) publish(topic string, payload []byte) error {
+  if self.down {
+    return errors.New("broker away")
+  }
+  self.sent = append(self.sent, topic + ":" + string(payload))
+  return nil
+}
+
+func tempOutbox(t *testing.T) (*Outbox, string) {
+  root, err := ioutil.TempDir("", "outbox")
+  if err != nil { t.Fatal(err) }
+  t.Cleanup(func() { os.RemoveAll(root) })
+
+  box, err := NewOutbox(root)
+  if err != nil { t.Fatal(err) }
+  return box, root
+}
+
+func checkSent(t *testing.T, got []string, want ...string) {
+  t.Helper()
+  if len(got) != len(want) {
+    t.Fatalf("sent %v, want %v", got, want)
+  }
+  for i := range want {
+    if got[i] != want[i] {
+      t.Fatalf("sent %v, want %v", got, want)
+    }
+  }
+}
+
+func TestOutboxOrder(t *testing.T) {
+  box, root := tempOutbox(t)
+  rec := &recorder{}
+
+  box.Publish("event", []byte("1"), rec.publish)
+  checkSent(t, rec.sent, "event:1")
+
+  rec.down = true
+  box.Publish("event", []byte("2"), rec.publish)
+  box.Publish("status", []byte("3"), rec.publish)
+
+  // queued messages survive restart and numbering goes on
+  box, err := NewOutbox(root)
+  if err != nil { t.Fatal(err) }
+  if box.seq != 2 {
+    t.Errorf("seq %d after restart, want 2", box.seq)
+  }
+
+  // new message goes out behind the queued ones
+  rec.down = false
+  box.Publish("event", []byte("4"), rec.publish)
+  checkSent(t, rec.sent, "event:1", "event:2", "status:3", "event:4")
+
+  if names, _ := box.names(); len(names) != 0 {
+    t.Errorf("left in outbox: %v", names)
+  }
+}
+
+func TestOutboxFlushStops(t *testing.T) {
+  box, _ := tempOutbox(t)
+  rec := &recorder{down: true}
+
+  box.Put("event", []byte("1"))
+  box.Put("event", []byte("2"))
+  if err := box.Flush(rec.publish); err == nil {
+    t.Fatalf("flush succeeded while down")
+  }
+  if names, _ := box.names(); len(names) != 2 {
+    t.Errorf("%d messages kept, want 2", len(names))
+  }
+
+  rec.down = false
+  if err := box.Flush(rec.publish); err != nil {
+    t.Fatal(err)
+  }
+  checkSent(t, rec.sent, "event:1", "event:2")
+}
+
+func TestOutboxMax(t *testing.T) {
+  defer func(max string) { OUTBOX_MAX = max }(OUTBOX_MAX)
+  OUTBOX_MAX = "2"
+
+  box, _ := tempOutbox(t)
+  for _, v := range []string{"1", "2", "3"} {
+    box.Put("event", []byte(v))
+  }
+
+  rec := &recorder{}
+  box.Flush(rec.publish)
+  // oldest dropped first
+  checkSent(t, rec.sent, "event:2", "event:3")
+}
+
+func TestSeqOf(t *testing.T) {
+  tests := map[string]int64{
+    "00000000000000000042.json": 42,
+    "00000000000000000007-a1b2.json": 7,
+    "queued.json": 0,
+  }
+  for name, want := range tests {
+    if got := seqOf(name); got != want {
+      t.Errorf("%s: got %d, want %d", name, got, want)
+    }
+  }
+}
@@ -0,0 +1,450 @@
+package publisher
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "sort"
+  "sync"
+  "time"
+  "crypto"
+  "context"
+  "strings"
+  "syscall"
+  "net/http"
+  "io/ioutil"
+  "os/signal"
+  "encoding/json"
+  "crypto/subtle"
+  "github.com/golang/glog"
+
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/transport"
+)
+
+var (
+  // address of publisher api, pull mode devices fetch manifests from it
+  PUBLISHER_ADDR = common.GetEnvOr("PUBLISHER_ADDR", ":8770")
+  // bearer token required to list and change manifests and groups, may only
+  // be empty if PUBLISHER_ADDR is on loopback
+  PUBLISHER_TOKEN = os.Getenv("PUBLISHER_TOKEN")
+  // token devices fetch manifests with, as bearer or query "token", required
+  // for manifests carrying registry credentials
+  PUBLISHER_FETCH_TOKEN = os.Getenv("PUBLISHER_FETCH_TOKEN")
+  // PEM public keys manifests must be signed with, not checked if empty
+  PUBLISHER_TRUSTED_KEYS = os.Getenv("PUBLISHER_TRUSTED_KEYS")
+)
+
+const (
+  // GET manifest resolved for device, PUT, POST or DELETE manifest of id
+  API_MANIFEST = "/manifest/"
+  // GET or PUT members of group
+  API_GROUP = "/group/"
+  // POST to publish stored manifest of id again
+  API_PUBLISH = "/publish/"
+  // max size of posted manifest
+  API_BODY_MAX = 4 * 1024 * 1024
+)
+
+type ApiResult struct {
+  Result string `json:"result,omitempty"`
+  Error string `json:"error,omitempty"`
+  // topics manifest was published to
+  Published []string `json:"published,omitempty"`
+  // error by topic manifest failed to be published to
+  Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Some topics failed to be published to
+type PublishError struct {
+  Failed map[string]string
+}
+
+func (e *PublishError) Error() string {
+  var topics []string
+  for topic := range e.Failed {
+    topics = append(topics, topic)
+  }
+  sort.Strings(topics)
+
+  var msgs []string
+  for _, topic := range topics {
+    msgs = append(msgs, fmt.Sprintf("%s: %s", topic, e.Failed[topic]))
+  }
+  return fmt.Sprintf("publish failed: %s", strings.Join(msgs, "; "))
+}
+
+// Stores manifests per device or group, pushes them to update manifest
+// topic of each device and serves them to pull mode devices
+type Publisher struct {
+  store *Store
+  // broker to push to, nil if push is disabled
+  sub *manifest.SubManifest
+  trusted []crypto.PublicKey
+  pub_mutex *sync.Mutex
+  api *http.Server
+}
+
+// Address is on loopback interface only
+func isLoopback(addr string) bool {
+  host, _, err := net.SplitHostPort(addr)
+  if err != nil { return false }
+  if host == "localhost" { return true }
+
+  ip := net.ParseIP(host)
+  return ip != nil && ip.IsLoopback()
+}
+
+func NewPublisher() (*Publisher, error) {
+  glog.Infof("%s", common.CurrentScope())
+
+  if PUBLISHER_TOKEN == "" && !isLoopback(PUBLISHER_ADDR) {
+    return nil, fmt.Errorf("PUBLISHER_TOKEN required to serve on %s", PUBLISHER_ADDR)
+  }
+
+  store, err := NewStore(PUBLISHER_ROOT)
+  if err != nil { return nil, err }
+
+  ret := &Publisher{
+    store: store,
+    pub_mutex: &sync.Mutex{},
+  }
+
+  if ret.sub, err = manifest.LoadSubMani(); err != nil {
+    glog.Infof("push disabled: %v", err)
+  }
+
+  if PUBLISHER_TRUSTED_KEYS != "" {
+    if ret.trusted, err = manifest.LoadPublicKeys(PUBLISHER_TRUSTED_KEYS); err != nil {
+      return nil, err
+    }
+  }
+
+  ret.api = &http.Server{Addr: PUBLISHER_ADDR, Handler: ret.apiHandler()}
+  return ret, nil
+}
+
+// Serve api until SIGTERM or SIGINT
+func (self *Publisher) Start() error {
+  glog.Infof("%s (%s)", common.CurrentScope(), PUBLISHER_ADDR)
+
+  go func() {
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+    sig := <-c
+    glog.Infof("received %v", sig)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+    self.api.Shutdown(ctx)
+  }()
+
+  if err := self.api.ListenAndServe(); err != http.ErrServerClosed {
+    return err
+  }
+  return nil
+}
+
+// Update manifest topic of device or group
+func topicOf(id string) string {
+  return fmt.Sprintf("%s/%s", common.TopicUpdateManifest, id)
+}
+
+// Topics manifest of id goes to, members of group are left out if they have
+// manifest of their own
+func (self *Publisher) targets(id string) ([]string, error) {
+  ret := []string{topicOf(id)}
+  for _, device := range self.store.Group(id) {
+    mani, err := self.store.Get(device)
+    if err != nil { return nil, err }
+    if mani == nil {
+      ret = append(ret, topicOf(device))
+    }
+  }
+  return ret, nil
+}
+
+// Push stored manifest of device or group to broker over one connection,
+// returns topics published to, PublishError if some failed
+func (self *Publisher) Publish(id string) ([]string, error) {
+  glog.Infof("%s (%s)", common.CurrentScope(), id)
+
+  if self.sub == nil {
+    return nil, fmt.Errorf("push disabled, SUB_MANIFEST not defined")
+  }
+
+  mani, err := self.store.Get(id)
+  if err != nil { return nil, err }
+  if mani == nil {
+    return nil, fmt.Errorf("no manifest for %s", id)
+  }
+
+  // devices in push mode take envelope in json, payload stays as signed
+  data, err := json.Marshal(mani)
+  if err != nil { return nil, err }
+
+  topics, err := self.targets(id)
+  if err != nil { return nil, err }
+
+  self.pub_mutex.Lock()
+  defer self.pub_mutex.Unlock()
+
+  pub, err := transport.NewTransport(nil, self.sub)
+  if err != nil { return nil, err }
+
+  errs, err := pub.PushAll(topics, data)
+  if err != nil {
+    return nil, fmt.Errorf("publish failed: %v", err)
+  }
+
+  var ret []string
+  failed := make(map[string]string)
+  for _, topic := range topics {
+    if err, ok := errs[topic]; ok {
+      failed[topic] = err.Error()
+      continue
+    }
+    ret = append(ret, topic)
+  }
+
+  if len(failed) > 0 {
+    return ret, &PublishError{Failed: failed}
+  }
+  return ret, nil
+}
+
+// Validate and store signed manifest in json or encoded, the envelope is
+// kept as received, manifest with registry credentials is refused unless
+// fetching requires PUBLISHER_FETCH_TOKEN
+func (self *Publisher) Put(id string, data []byte) error {
+  env, err := manifest.ParseEnvelope(data)
+  if err != nil {
+    return fmt.Errorf("invalid manifest: %v", err)
+  }
+
+  var mani *manifest.UpdateManifest
+  if self.trusted != nil {
+    mani, err = env.UpdateManifest(self.trusted)
+  } else {
+    mani, err = manifest.ParseUpdateMani(env.Payload)
+  }
+  if err != nil {
+    return fmt.Errorf("manifest rejected: %v", err)
+  }
+
+  if PUBLISHER_FETCH_TOKEN == "" {
+    for _, comp := range mani.Components {
+      if comp.Cred != "" {
+        return fmt.Errorf("manifest rejected: %s carries credentials, " +
+          "PUBLISHER_FETCH_TOKEN not defined", comp.Name)
+      }
+    }
+  }
+  return self.store.Put(id, env)
+}
+
+func (self *Publisher) apiHandler() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc(API_MANIFEST, self.handleManifest)
+  mux.HandleFunc(API_GROUP, self.handleGroup)
+  mux.HandleFunc(API_PUBLISH, self.handlePublish)
+  return mux
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+  data, err := json.Marshal(v)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  w.Write(data)
+}
+
+func writeResult(w http.ResponseWriter, status int, err error) {
+  if err != nil {
+    writeJson(w, status, &ApiResult{Error: err.Error()})
+    return
+  }
+  writeJson(w, status, &ApiResult{Result: "ok"})
+}
+
+// Result of publish, topics failed are listed apart
+func writePublished(w http.ResponseWriter, status int, topics []string, err error) {
+  if err == nil {
+    writeJson(w, status, &ApiResult{Result: "ok", Published: topics})
+    return
+  }
+
+  ret := &ApiResult{Error: err.Error(), Published: topics}
+  if e, ok := err.(*PublishError); ok {
+    ret.Failed = e.Failed
+  }
+  writeJson(w, http.StatusBadGateway, ret)
+}
+
+func tokenEqual(got, want string) bool {
+  return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Listing and changes need PUBLISHER_TOKEN if defined
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+  if PUBLISHER_TOKEN == "" || tokenEqual(r.Header.Get("Authorization"), "Bearer " + PUBLISHER_TOKEN) {
+    return true
+  }
+  writeJson(w, http.StatusUnauthorized, &ApiResult{Error: "unauthorized"})
+  return false
+}
+
+// Fetching needs PUBLISHER_FETCH_TOKEN if defined, PUBLISHER_TOKEN is
+// accepted as well
+func fetchAuthorized(w http.ResponseWriter, r *http.Request) bool {
+  auth := r.Header.Get("Authorization")
+  switch {
+  case PUBLISHER_FETCH_TOKEN == "":
+  case tokenEqual(auth, "Bearer " + PUBLISHER_FETCH_TOKEN):
+  case tokenEqual(r.URL.Query().Get("token"), PUBLISHER_FETCH_TOKEN):
+  case tokenEqual(auth, "Bearer " + PUBLISHER_TOKEN):
+  default:
+    writeJson(w, http.StatusUnauthorized, &ApiResult{Error: "unauthorized"})
+    return false
+  }
+  return true
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+  return ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_BODY_MAX))
+}
+
+// GET encoded manifest resolved for device as FetchUpdateMani expects,
+// GET without id lists ids with manifest for token holder, PUT or POST signed manifest of device or
+// group in json or encoded and publish it unless query "publish" is false,
+// DELETE manifest
+func (self *Publisher) handleManifest(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s (%s %s)", common.CurrentScope(), r.Method, r.URL.Path)
+  id := strings.TrimPrefix(r.URL.Path, API_MANIFEST)
+
+  switch r.Method {
+  case http.MethodGet:
+    if id == "" {
+      if !authorized(w, r) { return }
+
+      ids, err := self.store.Ids()
+      if err != nil {
+        writeResult(w, http.StatusInternalServerError, err)
+        return
+      }
+      writeJson(w, http.StatusOK, ids)
+      return
+    }
+    if !fetchAuthorized(w, r) { return }
+
+    mani, _, err := self.store.Resolve(id)
+    if err != nil {
+      writeResult(w, http.StatusBadRequest, err)
+      return
+    }
+    if mani == nil {
+      writeResult(w, http.StatusNotFound, fmt.Errorf("no manifest for %s", id))
+      return
+    }
+
+    data, err := mani.Encode()
+    if err != nil {
+      writeResult(w, http.StatusInternalServerError, err)
+      return
+    }
+    w.Header().Set("Content-Type", "text/plain")
+    w.Write([]byte(data))
+  case http.MethodPut, http.MethodPost:
+    if !authorized(w, r) { return }
+
+    data, err := readBody(w, r)
+    if err != nil {
+      writeResult(w, http.StatusBadRequest, err)
+      return
+    }
+
+    if err := self.Put(id, data); err != nil {
+      writeResult(w, http.StatusBadRequest, err)
+      return
+    }
+
+    if r.URL.Query().Get("publish") == "false" || self.sub == nil {
+      writeResult(w, http.StatusCreated, nil)
+      return
+    }
+
+    topics, err := self.Publish(id)
+    writePublished(w, http.StatusCreated, topics, err)
+  case http.MethodDelete:
+    if !authorized(w, r) { return }
+
+    if err := self.store.Delete(id); err != nil {
+      writeResult(w, http.StatusBadRequest, err)
+      return
+    }
+    writeResult(w, http.StatusOK, nil)
+  default:
+    w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+    writeResult(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+  }
+}
+
+// GET or PUT json list of devices in group, empty list removes group
+func (self *Publisher) handleGroup(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s (%s %s)", common.CurrentScope(), r.Method, r.URL.Path)
+  group := strings.TrimPrefix(r.URL.Path, API_GROUP)
+
+  switch r.Method {
+  case http.MethodGet:
+    if !authorized(w, r) { return }
+
+    devices := self.store.Group(group)
+    if devices == nil {
+      writeResult(w, http.StatusNotFound, fmt.Errorf("no such group: %s", group))
+      return
+    }
+    writeJson(w, http.StatusOK, devices)
+  case http.MethodPut:
+    if !authorized(w, r) { return }
+
+    data, err := readBody(w, r)
+    if err != nil {
+      writeResult(w, http.StatusBadRequest, err)
+      return
+    }
+
+    var devices []string
+    if err := json.Unmarshal(data, &devices); err != nil {
+      writeResult(w, http.StatusBadRequest, err)
+      return
+    }
+
+    if err := self.store.SetGroup(group, devices); err != nil {
+      writeResult(w, http.StatusBadRequest, err)
+      return
+    }
+    writeResult(w, http.StatusOK, nil)
+  default:
+    w.Header().Set("Allow", "GET, PUT")
+    writeResult(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+  }
+}
+
+// POST to push stored manifest of device or group again
+func (self *Publisher) handlePublish(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s (%s)", common.CurrentScope(), r.URL.Path)
+  if r.Method != http.MethodPost {
+    w.Header().Set("Allow", http.MethodPost)
+    writeResult(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+    return
+  }
+  if !authorized(w, r) { return }
+
+  topics, err := self.Publish(strings.TrimPrefix(r.URL.Path, API_PUBLISH))
+  writePublished(w, http.StatusOK, topics, err)
+}
@@ -0,0 +1,68 @@
+package publisher
+
+import (
+  "strings"
+  "testing"
+  "net/http"
+  "net/http/httptest"
+)
+
+func TestIsLoopback(t *testing.T) {
+  tests := map[string]bool{
+    "127.0.0.1:8770": true,
+    "localhost:8770": true,
+    "[::1]:8770": true,
+    ":8770": false,
+    "0.0.0.0:8770": false,
+    "10.0.0.1:8770": false,
+    "localhost": false,
+  }
+  for addr, want := range tests {
+    if got := isLoopback(addr); got != want {
+      t.Errorf("%s: got %v, want %v", addr, got, want)
+    }
+  }
+}
+
+func TestApiAuthorized(t *testing.T) {
+  defer func(token, fetch string) {
+    PUBLISHER_TOKEN, PUBLISHER_FETCH_TOKEN = token, fetch
+  }(PUBLISHER_TOKEN, PUBLISHER_FETCH_TOKEN)
+  PUBLISHER_TOKEN, PUBLISHER_FETCH_TOKEN = "admin", "fetch"
+
+  store, _ := tempStore(t)
+  store.SetGroup("beta", []string{"dev1"})
+  store.Put("dev1", envelope("{}"))
+  api := (&Publisher{store: store}).apiHandler()
+
+  tests := []struct {
+    method string
+    path string
+    auth string
+    want int
+  }{
+    {"GET", API_GROUP + "beta", "", http.StatusUnauthorized},
+    {"GET", API_GROUP + "beta", "Bearer fetch", http.StatusUnauthorized},
+    {"GET", API_GROUP + "beta", "Bearer admin", http.StatusOK},
+    {"PUT", API_GROUP + "beta", "Bearer fetch", http.StatusUnauthorized},
+    {"GET", API_MANIFEST, "Bearer fetch", http.StatusUnauthorized},
+    {"GET", API_MANIFEST, "Bearer admin", http.StatusOK},
+    {"GET", API_MANIFEST + "dev1", "", http.StatusUnauthorized},
+    {"GET", API_MANIFEST + "dev1", "Bearer fetch", http.StatusOK},
+    {"GET", API_MANIFEST + "dev1", "Bearer admin", http.StatusOK},
+    {"DELETE", API_MANIFEST + "dev1", "Bearer fetch", http.StatusUnauthorized},
+    {"POST", API_PUBLISH + "dev1", "", http.StatusUnauthorized},
+  }
+
+  for _, tt := range tests {
+    req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("[]"))
+    if tt.auth != "" {
+      req.Header.Set("Authorization", tt.auth)
+    }
+    rec := httptest.NewRecorder()
+    api.ServeHTTP(rec, req)
+    if rec.Code != tt.want {
+      t.Errorf("%s %s (%q): got %d, want %d", tt.method, tt.path, tt.auth, rec.Code, tt.want)
+    }
+  }
+}
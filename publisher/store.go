@@ -0,0 +1,218 @@
+package publisher
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "sync"
+  "regexp"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "github.com/golang/glog"
+
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/manifest"
+)
+
+var (
+  PUBLISHER_ROOT = common.GetEnvOr("PUBLISHER_ROOT", "/opt/.publisher")
+)
+
+const (
+  MANIFEST_DIR = "manifests"
+  GROUPS_FILE = "groups.json"
+)
+
+// Device and group ids, also used in file names and topics
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func checkId(id string) error {
+  if !idPattern.MatchString(id) || id == "." || id == ".." {
+    return fmt.Errorf("invalid id: %q", id)
+  }
+  return nil
+}
+
+// Signed update manifests by device or group id, one json file each, and members
+// of groups
+type Store struct {
+  mutex *sync.Mutex
+  root string
+  // devices by group
+  groups map[string][]string
+}
+
+func NewStore(root string) (*Store, error) {
+  glog.Infof("%s (%s)", common.CurrentScope(), root)
+
+  if err := os.MkdirAll(filepath.Join(root, MANIFEST_DIR), 0700); err != nil {
+    return nil, err
+  }
+
+  ret := &Store{
+    mutex: &sync.Mutex{},
+    root: root,
+    groups: make(map[string][]string),
+  }
+
+  data, err := ioutil.ReadFile(filepath.Join(root, GROUPS_FILE))
+  if err != nil && !os.IsNotExist(err) {
+    return nil, err
+  }
+  if len(data) > 0 {
+    if err := json.Unmarshal(data, &ret.groups); err != nil {
+      return nil, fmt.Errorf("invalid %s: %v", GROUPS_FILE, err)
+    }
+  }
+  return ret, nil
+}
+
+func (self *Store) maniPath(id string) string {
+  return filepath.Join(self.root, MANIFEST_DIR, id + ".json")
+}
+
+// Write to temporary file and rename so that readers never see partial data
+func writeFile(path string, data []byte) error {
+  tmp := path + ".tmp"
+  if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+    return err
+  }
+  return os.Rename(tmp, path)
+}
+
+// Keep signed manifest as received
+func (self *Store) Put(id string, env *manifest.Envelope) error {
+  if err := checkId(id); err != nil { return err }
+
+  data, err := json.Marshal(env)
+  if err != nil { return err }
+
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return writeFile(self.maniPath(id), data)
+}
+
+// Manifest stored for id, nil if none
+func (self *Store) Get(id string) (*manifest.Envelope, error) {
+  if err := checkId(id); err != nil { return nil, err }
+
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.get(id)
+}
+
+func (self *Store) get(id string) (*manifest.Envelope, error) {
+  data, err := ioutil.ReadFile(self.maniPath(id))
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil { return nil, err }
+
+  var env manifest.Envelope
+  if err := json.Unmarshal(data, &env); err != nil {
+    return nil, err
+  }
+  return &env, nil
+}
+
+func (self *Store) Delete(id string) error {
+  if err := checkId(id); err != nil { return err }
+
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  if err := os.Remove(self.maniPath(id)); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return nil
+}
+
+// Ids with a manifest stored
+func (self *Store) Ids() ([]string, error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  files, err := filepath.Glob(filepath.Join(self.root, MANIFEST_DIR, "*.json"))
+  if err != nil { return nil, err }
+
+  var ret []string
+  for _, f := range files {
+    ret = append(ret, filepath.Base(f[:len(f) - len(".json")]))
+  }
+  return ret, nil
+}
+
+// Manifest for device, its own if stored, of its first group by name
+// otherwise, nil if neither, along with id it's stored by
+func (self *Store) Resolve(device string) (*manifest.Envelope, string, error) {
+  if err := checkId(device); err != nil { return nil, "", err }
+
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  mani, err := self.get(device)
+  if err != nil || mani != nil {
+    return mani, device, err
+  }
+
+  for _, group := range self.groupsOf(device) {
+    mani, err := self.get(group)
+    if err != nil || mani != nil {
+      return mani, group, err
+    }
+  }
+  return nil, "", nil
+}
+
+// Groups device belongs to, sorted by name
+func (self *Store) groupsOf(device string) []string {
+  var ret []string
+  for group, devices := range self.groups {
+    for _, d := range devices {
+      if d == device {
+        ret = append(ret, group)
+        break
+      }
+    }
+  }
+  sort.Strings(ret)
+  return ret
+}
+
+// Replace members of group, group is removed if devices is empty
+func (self *Store) SetGroup(group string, devices []string) error {
+  if err := checkId(group); err != nil { return err }
+  for _, d := range devices {
+    if err := checkId(d); err != nil { return err }
+  }
+
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  groups := make(map[string][]string, len(self.groups))
+  for g, d := range self.groups {
+    groups[g] = d
+  }
+  if len(devices) == 0 {
+    delete(groups, group)
+  } else {
+    groups[group] = devices
+  }
+
+  data, err := json.Marshal(groups)
+  if err != nil { return err }
+
+  if err := writeFile(filepath.Join(self.root, GROUPS_FILE), data); err != nil {
+    return err
+  }
+  self.groups = groups
+  return nil
+}
+
+// Members of group, nil if no such group
+func (self *Store) Group(group string) []string {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return append([]string(nil), self.groups[group]...)
+}
@@ -0,0 +1,120 @@
+package publisher
+
+import (
+  "os"
+  "sort"
+  "testing"
+  "io/ioutil"
+  "github.com/zex/container-update/manifest"
+)
+
+func tempStore(t *testing.T) (*Store, string) {
+  root, err := ioutil.TempDir("", "publisher")
+  if err != nil { t.Fatal(err) }
+  t.Cleanup(func() { os.RemoveAll(root) })
+
+  store, err := NewStore(root)
+  if err != nil { t.Fatal(err) }
+  return store, root
+}
+
+func envelope(payload string) *manifest.Envelope {
+  return &manifest.Envelope{
+    Type: manifest.ENVELOPE_UPDATE,
+    Payload: []byte(payload),
+    Digest: "d-" + payload,
+    Signature: "s",
+  }
+}
+
+// Id manifest for device is stored by, empty if none
+func resolved(t *testing.T, store *Store, device string) string {
+  env, id, err := store.Resolve(device)
+  if err != nil { t.Fatal(err) }
+  if env == nil { return "" }
+  if env.Digest != "d-" + id {
+    t.Errorf("%s: manifest of %s returned as of %s", device, env.Digest, id)
+  }
+  return id
+}
+
+func TestStoreResolve(t *testing.T) {
+  store, root := tempStore(t)
+
+  store.Put("dev1", envelope("dev1"))
+  store.Put("beta", envelope("beta"))
+  store.Put("all", envelope("all"))
+  store.SetGroup("beta", []string{"dev2"})
+  store.SetGroup("all", []string{"dev1", "dev2", "dev3"})
+
+  tests := map[string]string{
+    // own manifest over group
+    "dev1": "dev1",
+    // first group by name
+    "dev2": "all",
+    "dev3": "all",
+    "dev4": "",
+  }
+  for device, want := range tests {
+    if got := resolved(t, store, device); got != want {
+      t.Errorf("%s: resolved to %q, want %q", device, got, want)
+    }
+  }
+
+  // groups are kept across restart, empty group is removed
+  store.SetGroup("all", nil)
+  store, err := NewStore(root)
+  if err != nil { t.Fatal(err) }
+  if got := store.Group("beta"); len(got) != 1 || got[0] != "dev2" {
+    t.Errorf("beta: got %v", got)
+  }
+  if got := store.Group("all"); got != nil {
+    t.Errorf("removed group: got %v", got)
+  }
+  if got := resolved(t, store, "dev2"); got != "beta" {
+    t.Errorf("dev2: resolved to %q after restart, want beta", got)
+  }
+
+  store.Delete("dev1")
+  ids, _ := store.Ids()
+  sort.Strings(ids)
+  if len(ids) != 2 || ids[0] != "all" || ids[1] != "beta" {
+    t.Errorf("ids: got %v", ids)
+  }
+}
+
+func TestStoreEnvelopeKept(t *testing.T) {
+  store, _ := tempStore(t)
+
+  want := envelope(`{"components":[]}`)
+  if err := store.Put("dev1", want); err != nil { t.Fatal(err) }
+
+  got, err := store.Get("dev1")
+  if err != nil { t.Fatal(err) }
+  if got.Type != want.Type || string(got.Payload) != string(want.Payload) ||
+      got.Digest != want.Digest || got.Signature != want.Signature {
+    t.Errorf("got %+v, want %+v", got, want)
+  }
+
+  if got, err := store.Get("dev2"); got != nil || err != nil {
+    t.Errorf("missing manifest: got %v, %v", got, err)
+  }
+}
+
+func TestCheckId(t *testing.T) {
+  store, _ := tempStore(t)
+
+  for _, id := range []string{"", ".", "..", "../etc", "a/b", "dev 1"} {
+    if err := store.Put(id, envelope("{}")); err == nil {
+      t.Errorf("%q accepted", id)
+    }
+    if err := store.SetGroup("g", []string{id}); err == nil {
+      t.Errorf("%q accepted as member", id)
+    }
+  }
+  for _, id := range []string{"dev-1", "rack_2.a"} {
+    if err := checkId(id); err != nil {
+      t.Errorf("%q refused: %v", id, err)
+    }
+  }
+}
@@ -4,7 +4,12 @@ import (
   "os"
   "time"
   "fmt"
+  "sync"
+  "strconv"
+  "context"
+  "math/rand"
   "github.com/golang/glog"
+  "github.com/robfig/cron"
   "github.com/zex/container-update/common"
 )
 
@@ -14,6 +19,7 @@ var (
 
 const (
   SCHED_DURATION_DEFAULT = "24h"
+  SCHED_JITTER_DEFAULT = "0s"
 )
 
 type TimeoutHandler interface {
@@ -22,18 +28,77 @@ type TimeoutHandler interface {
 
 type Sched struct {
   TimeoutHandler
-  dur time.Duration
+  sched cron.Schedule
+  // upper bound of random delay added to each scheduled run
+  jitter time.Duration
+  // run once right after start
+  on_start bool
+  stop chan struct{}
+  stop_once *sync.Once
 }
 
-func (s *Sched) StartSched() {
+func init() {
+  rand.Seed(time.Now().UnixNano())
+}
+
+// Run handler on schedule until context is done or Stop is called
+func (s *Sched) Start(ctx context.Context) {
+  glog.Infof("%s", common.CurrentScope())
+
+  // fleet restarting together is spread as well
+  if s.on_start {
+    if !s.wait(ctx, s.jitterDelay()) { return }
+    s.TimeoutHandler.RunOnce()
+  }
+
+  for {
+    now := time.Now()
+    next := s.sched.Next(now).Add(s.jitterDelay())
+    glog.Infof("next run at %v", next)
+
+    timer := time.NewTimer(next.Sub(now))
+    select {
+    case <-ctx.Done():
+      timer.Stop()
+      return
+    case <-s.stop:
+      timer.Stop()
+      return
+    case <-timer.C:
+      s.sched_timeout()
+    }
+  }
+}
+
+// Sleep unless stopped first, false if stopped
+func (s *Sched) wait(ctx context.Context, d time.Duration) bool {
+  if d <= 0 { return true }
+  glog.Infof("first run in %v", d)
+
+  timer := time.NewTimer(d)
+  defer timer.Stop()
+
+  select {
+  case <-ctx.Done():
+    return false
+  case <-s.stop:
+    return false
+  case <-timer.C:
+    return true
+  }
+}
+
+// Stop scheduling, a run in progress is not interrupted
+func (s *Sched) Stop() {
   glog.Infof("%s", common.CurrentScope())
-  time.AfterFunc(s.dur, s.sched_timeout)
-  s.run()
+  s.stop_once.Do(func() { close(s.stop) })
 }
 
-func (s *Sched) run() {
-  c := make(chan os.Signal, 1)
-  <-c
+func (s *Sched) jitterDelay() time.Duration {
+  if s.jitter <= 0 {
+    return 0
+  }
+  return time.Duration(rand.Int63n(int64(s.jitter)))
 }
 
 func readDuration() (time.Duration) {
@@ -50,15 +115,48 @@ func readDuration() (time.Duration) {
   return dur
 }
 
+// Schedule from SCHED_CRON if given, SCHED_DURATION otherwise
+func readSchedule() cron.Schedule {
+  spec := os.Getenv("SCHED_CRON")
+  if spec == "" {
+    return cron.Every(readDuration())
+  }
+
+  sched, err := cron.ParseStandard(spec)
+  if err != nil {
+    panic(fmt.Sprintf("invalid cron: %v", err))
+  }
+  return sched
+}
+
+func readJitter() time.Duration {
+  jitter, err := time.ParseDuration(common.GetEnvOr("SCHED_JITTER", SCHED_JITTER_DEFAULT))
+  if err != nil {
+    panic(fmt.Sprintf("invalid jitter: %v", err))
+  }
+  return jitter
+}
+
+func readRunOnStart() bool {
+  on_start, err := strconv.ParseBool(common.GetEnvOr("SCHED_RUN_ON_START", "true"))
+  if err != nil {
+    panic(fmt.Sprintf("invalid run on start: %v", err))
+  }
+  return on_start
+}
+
 func (s *Sched) sched_timeout() {
   glog.Infof("%s", common.CurrentScope())
   s.TimeoutHandler.RunOnce()
-  time.AfterFunc(s.dur, s.sched_timeout)
 }
 
 func NewSched(h TimeoutHandler) *Sched {
   return &Sched{
     TimeoutHandler: h,
-    dur: readDuration(),
+    sched: readSchedule(),
+    jitter: readJitter(),
+    on_start: readRunOnStart(),
+    stop: make(chan struct{}),
+    stop_once: &sync.Once{},
   }
 }
@@ -0,0 +1,307 @@
+package state
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "time"
+  "bufio"
+  "bytes"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "github.com/golang/glog"
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/manifest"
+)
+
+var (
+  // Kept apart from UPDATER_ROOT, which is replaced on updater deploy
+  STATE_ROOT = common.GetEnvOr("STATE_ROOT", "/opt/.updater_state")
+  // max number of records kept in journal
+  HISTORY_MAX = 200
+)
+
+const (
+  JOURNAL_FILE = "journal.json"
+  // record of manifest being set up, journaled on next start if the process
+  // ended before it's appended, e.g. updater replaced its own container
+  INPROGRESS_FILE = "inprogress.json"
+  // creation time of the last applied manifest, kept by updater before the
+  // journal, imported once
+  LEGACY_LAST_APPLIED = "/opt/.updater_last_applied"
+)
+
+type Outcome string
+
+const (
+  OutcomeUpdated Outcome = "updated"
+  OutcomeUnchanged Outcome = "unchanged"
+  OutcomeFailed Outcome = "failed"
+  OutcomeSkipped Outcome = "skipped"
+)
+
+// Result of one component in an applied manifest
+type CompRecord struct {
+  Name string `json:"name"`
+  ContainerName string `json:"container_name,omitempty"`
+  PrevImage string `json:"prev_image,omitempty"`
+  PrevDigest string `json:"prev_digest,omitempty"`
+  Image string `json:"image,omitempty"`
+  Digest string `json:"digest,omitempty"`
+  StartedAt time.Time `json:"started_at,omitempty"`
+  FinishedAt time.Time `json:"finished_at,omitempty"`
+  Outcome Outcome `json:"outcome"`
+  Error string `json:"error,omitempty"`
+  // why the component was updated
+  Reasons []string `json:"reasons,omitempty"`
+  // component as given in manifest
+  Spec *manifest.Component `json:"spec,omitempty"`
+}
+
+// One applied update manifest
+type Record struct {
+  ManifestCreatedAt time.Time `json:"manifest_created_at"`
+  ManifestDigest string `json:"manifest_digest,omitempty"`
+  AppliedAt time.Time `json:"applied_at"`
+  Components []CompRecord `json:"components,omitempty"`
+  // process ended before all components were set up
+  Interrupted bool `json:"interrupted,omitempty"`
+  // imported from legacy marker, components unknown
+  Imported bool `json:"imported,omitempty"`
+}
+
+// Manifest took effect, at least one component is updated or found up to
+// date, a manifest which failed entirely may be applied again
+func (self *Record) Applied() bool {
+  if self.Imported { return true }
+  for _, comp := range self.Components {
+    if comp.Outcome == OutcomeUpdated || comp.Outcome == OutcomeUnchanged {
+      return true
+    }
+  }
+  return false
+}
+
+// Journal of applied manifests, one json record per line
+type Store struct {
+  mutex *sync.Mutex
+  path string
+  inprogress string
+  records []Record
+}
+
+func NewStore(root string) (*Store, error) {
+  glog.Infof("%s (%s)", common.CurrentScope(), root)
+
+  if err := os.MkdirAll(root, 0700); err != nil {
+    return nil, err
+  }
+
+  ret := &Store{
+    mutex: &sync.Mutex{},
+    path: filepath.Join(root, JOURNAL_FILE),
+    inprogress: filepath.Join(root, INPROGRESS_FILE),
+  }
+
+  if err := ret.load(); err != nil {
+    return nil, err
+  }
+
+  if err := ret.recover(); err != nil {
+    glog.Errorf("failed to recover interrupted record: %v", err)
+  }
+
+  if err := ret.importLegacy(LEGACY_LAST_APPLIED); err != nil {
+    glog.Errorf("failed to import %s: %v", LEGACY_LAST_APPLIED, err)
+  }
+  return ret, nil
+}
+
+// Journal record left in progress by previous run
+func (self *Store) recover() error {
+  data, err := ioutil.ReadFile(self.inprogress)
+  if os.IsNotExist(err) { return nil }
+  if err != nil { return err }
+
+  var rec Record
+  if err := json.Unmarshal(data, &rec); err != nil {
+    os.Remove(self.inprogress)
+    return err
+  }
+
+  glog.Infof("manifest created at %v was interrupted", rec.ManifestCreatedAt)
+  rec.Interrupted = true
+  return self.Append(rec)
+}
+
+// Journal last applied time kept in marker file by updater before the
+// journal, so that manifests are not replayed after upgrade
+func (self *Store) importLegacy(marker string) error {
+  data, err := ioutil.ReadFile(marker)
+  if os.IsNotExist(err) { return nil }
+  if err != nil { return err }
+
+  if len(self.records) == 0 {
+    var last time.Time
+    if err := last.UnmarshalText(bytes.TrimSpace(data)); err != nil {
+      return err
+    }
+
+    glog.Infof("import last applied %v from %s", last, marker)
+    if err := self.Append(Record{ManifestCreatedAt: last, AppliedAt: time.Now(), Imported: true}); err != nil {
+      return err
+    }
+  }
+  return os.Remove(marker)
+}
+
+// Keep record of manifest being set up until it's appended
+func (self *Store) Begin(rec Record) error {
+  data, err := json.Marshal(rec)
+  if err != nil { return err }
+
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  tmp := fmt.Sprintf("%s.tmp", self.inprogress)
+  if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+    return err
+  }
+  return os.Rename(tmp, self.inprogress)
+}
+
+func (self *Store) load() error {
+  fd, err := os.OpenFile(self.path, os.O_RDONLY, 0600)
+  if os.IsNotExist(err) { return nil }
+  if err != nil { return err }
+  defer fd.Close()
+
+  scanner := bufio.NewScanner(fd)
+  scanner.Buffer(nil, 16 * 1024 * 1024)
+  for scanner.Scan() {
+    var rec Record
+    if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+      // a torn write leaves at most one broken line
+      glog.Errorf("skip broken record: %v", err)
+      continue
+    }
+    self.records = append(self.records, rec)
+  }
+  return scanner.Err()
+}
+
+// Append record to journal, journal is compacted when exceeding HISTORY_MAX
+func (self *Store) Append(rec Record) error {
+  glog.Infof("%s", common.CurrentScope())
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  defer os.Remove(self.inprogress)
+
+  self.records = append(self.records, rec)
+  if len(self.records) > HISTORY_MAX {
+    self.records = self.records[len(self.records)-HISTORY_MAX:]
+    return self.rewrite()
+  }
+
+  data, err := json.Marshal(rec)
+  if err != nil { return err }
+
+  fd, err := os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+  if err != nil { return err }
+  defer fd.Close()
+
+  if _, err := fd.Write(append(data, '\n')); err != nil {
+    return err
+  }
+  return fd.Sync()
+}
+
+func (self *Store) rewrite() error {
+  tmp := fmt.Sprintf("%s.tmp", self.path)
+  fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+  if err != nil { return err }
+
+  wr := bufio.NewWriter(fd)
+  for _, rec := range self.records {
+    data, err := json.Marshal(rec)
+    if err != nil {
+      fd.Close()
+      return err
+    }
+    wr.Write(append(data, '\n'))
+  }
+
+  if err := wr.Flush(); err != nil {
+    fd.Close()
+    return err
+  }
+
+  if err := fd.Sync(); err != nil {
+    fd.Close()
+    return err
+  }
+  fd.Close()
+
+  return os.Rename(tmp, self.path)
+}
+
+// Records from the newest, at most limit records, all if limit <= 0
+func (self *Store) History(limit int) []Record {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  n := len(self.records)
+  if limit <= 0 || limit > n { limit = n }
+
+  ret := make([]Record, 0, limit)
+  for i := n - 1; i >= n - limit; i-- {
+    ret = append(ret, self.records[i])
+  }
+  return ret
+}
+
+// Creation time of the newest manifest ever applied, zero if none
+func (self *Store) LastApplied() time.Time {
+  if rec := self.LastAppliedRecord(); rec != nil {
+    return rec.ManifestCreatedAt
+  }
+  return time.Time{}
+}
+
+// Record of the newest manifest ever applied, nil if none, records of
+// manifests which failed entirely are left out
+func (self *Store) LastAppliedRecord() *Record {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  var last *Record
+  for i := range self.records {
+    rec := &self.records[i]
+    if !rec.Applied() { continue }
+    if last == nil || rec.ManifestCreatedAt.After(last.ManifestCreatedAt) {
+      last = rec
+    }
+  }
+
+  if last == nil { return nil }
+  ret := *last
+  return &ret
+}
+
+// Latest record of given component, nil if never applied
+func (self *Store) LastComponent(name string) *CompRecord {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+
+  for i := len(self.records) - 1; i >= 0; i-- {
+    for _, comp := range self.records[i].Components {
+      if comp.Name == name {
+        ret := comp
+        return &ret
+      }
+    }
+  }
+  return nil
+}
@@ -0,0 +1,134 @@
+package state
+
+import (
+  "os"
+  "time"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+)
+
+func tempStore(t *testing.T) (*Store, string) {
+  root, err := ioutil.TempDir("", "state")
+  if err != nil { t.Fatal(err) }
+  t.Cleanup(func() { os.RemoveAll(root) })
+
+  store, err := NewStore(root)
+  if err != nil { t.Fatal(err) }
+  return store, root
+}
+
+func record(created time.Time, outcomes ...Outcome) Record {
+  rec := Record{ManifestCreatedAt: created, AppliedAt: time.Now()}
+  for _, outcome := range outcomes {
+    rec.Components = append(rec.Components, CompRecord{Name: "web", Outcome: outcome})
+  }
+  return rec
+}
+
+func TestApplied(t *testing.T) {
+  now := time.Now()
+  tests := []struct {
+    name string
+    rec Record
+    want bool
+  }{
+    {"updated", record(now, OutcomeFailed, OutcomeUpdated), true},
+    {"unchanged", record(now, OutcomeUnchanged), true},
+    {"failed", record(now, OutcomeFailed, OutcomeSkipped), false},
+    {"empty", record(now), false},
+    {"imported", Record{ManifestCreatedAt: now, Imported: true}, true},
+  }
+
+  for _, tt := range tests {
+    if got := tt.rec.Applied(); got != tt.want {
+      t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestLastAppliedRecord(t *testing.T) {
+  store, root := tempStore(t)
+  now := time.Now().UTC().Truncate(time.Second)
+
+  if store.LastAppliedRecord() != nil || !store.LastApplied().IsZero() {
+    t.Fatalf("empty store has last applied")
+  }
+
+  store.Append(record(now.Add(time.Hour), OutcomeUpdated))
+  // newer but failed entirely, watermark is not advanced
+  store.Append(record(now.Add(2 * time.Hour), OutcomeFailed))
+  // appended later but older
+  store.Append(record(now, OutcomeUnchanged))
+
+  last := store.LastAppliedRecord()
+  if last == nil || !last.ManifestCreatedAt.Equal(now.Add(time.Hour)) {
+    t.Fatalf("got %v, want record of %v", last, now.Add(time.Hour))
+  }
+
+  // a copy is returned
+  last.Components = nil
+  if store.LastAppliedRecord().Components == nil {
+    t.Errorf("record in store changed")
+  }
+
+  // journal is read back on start
+  store, err := NewStore(root)
+  if err != nil { t.Fatal(err) }
+  if got := len(store.History(0)); got != 3 {
+    t.Errorf("reloaded %d records, want 3", got)
+  }
+  if !store.LastApplied().Equal(now.Add(time.Hour)) {
+    t.Errorf("reloaded last applied %v", store.LastApplied())
+  }
+}
+
+func TestRecover(t *testing.T) {
+  store, root := tempStore(t)
+  now := time.Now().UTC().Truncate(time.Second)
+
+  if err := store.Begin(record(now, OutcomeUpdated)); err != nil {
+    t.Fatal(err)
+  }
+
+  store, err := NewStore(root)
+  if err != nil { t.Fatal(err) }
+
+  hist := store.History(0)
+  if len(hist) != 1 || !hist[0].Interrupted || !hist[0].ManifestCreatedAt.Equal(now) {
+    t.Fatalf("got %+v, want interrupted record", hist)
+  }
+  if _, err := os.Stat(filepath.Join(root, INPROGRESS_FILE)); !os.IsNotExist(err) {
+    t.Errorf("in progress record left: %v", err)
+  }
+}
+
+func TestImportLegacy(t *testing.T) {
+  store, root := tempStore(t)
+  now := time.Now().UTC().Truncate(time.Second)
+
+  marker := filepath.Join(root, "last_applied")
+  data, _ := now.MarshalText()
+  if err := ioutil.WriteFile(marker, append(data, '\n'), 0600); err != nil {
+    t.Fatal(err)
+  }
+
+  if err := store.importLegacy(marker); err != nil {
+    t.Fatal(err)
+  }
+  if !store.LastApplied().Equal(now) {
+    t.Errorf("got last applied %v, want %v", store.LastApplied(), now)
+  }
+  if _, err := os.Stat(marker); !os.IsNotExist(err) {
+    t.Errorf("marker left: %v", err)
+  }
+
+  // marker is not imported over the journal
+  ioutil.WriteFile(marker, []byte("2000-01-01T00:00:00Z"), 0600)
+  if err := store.importLegacy(marker); err != nil {
+    t.Fatal(err)
+  }
+  if len(store.History(0)) != 1 {
+    t.Errorf("marker imported into journal with records")
+  }
+}
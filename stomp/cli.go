@@ -1,80 +1,239 @@
 package stomp
 
 import (
+  "fmt"
+  "sync"
   "time"
-  "encoding/json"
+  "context"
+  "net/url"
+  "crypto/tls"
   "github.com/golang/glog"
   "github.com/go-stomp/stomp"
   "github.com/zex/container-update/common"
   "github.com/zex/container-update/manifest"
 )
 
-type MsgHandler interface {
-  Handle(msg *stomp.Message)
-}
+var (
+  ContentType = "application/json"
+  // max wait between connect attempts, doubled from one second on failure
+  ReconnectMax = common.GetEnvOr("STOMP_RECONNECT_MAX", "2m")
+)
 
 type Sub struct {
-  MsgHandler
-  sub *stomp.Subscription
+  common.MsgHandler
+  mani *manifest.SubManifest
+  // destinations subscribed to
+  topics []string
+  conn_mutex *sync.Mutex
+  conn *stomp.Conn
 }
 
-func NewSub(h MsgHandler) Sub {
-  return Sub{ MsgHandler: h }
+func NewSub(h common.MsgHandler, mani *manifest.SubManifest) *Sub {
+  return &Sub{
+    MsgHandler: h,
+    mani: mani,
+    conn_mutex: &sync.Mutex{},
+  }
 }
 
-func (s *Sub) subUpdate(mani *manifest.SubManifest) {
+// Queue defined in subscription manifest by key, topic if no such queue
+func (s *Sub) Topic(key string) string {
+  if queue := s.mani.Queues[key]; queue != "" {
+    return queue
+  }
+  return s.mani.Topics[key]
+}
+
+// Subscribe to update manifest and activate destinations
+func (s *Sub) SubUpdate() {
   glog.Infof("%s", common.CurrentScope())
 
-  var opts []func(*stomp.Conn) error = []func(*stomp.Conn) error {
-    stomp.ConnOpt.Login(mani.Cred.User, mani.Cred.Pass),
-    stomp.ConnOpt.Host(mani.Uri),
+  s.topics = []string{s.Topic(common.TopicUpdateManifest)}
+  for _, key := range []string{common.TopicActivate, common.TopicCommand} {
+    if topic := s.Topic(key); topic != "" {
+      s.topics = append(s.topics, topic)
+    }
+  }
+}
+
+// Connect with stomp://host:port, or stomp+ssl://host:port over TLS
+func (s *Sub) dial() (*stomp.Conn, error) {
+  u, err := url.Parse(s.mani.Uri)
+  if err != nil { return nil, err }
+
+  opts := []func(*stomp.Conn) error {
+    stomp.ConnOpt.Login(s.mani.Cred.User, s.mani.Cred.Pass),
+    stomp.ConnOpt.Host(u.Hostname()),
     stomp.ConnOpt.HeartBeatError(360 * time.Second),
-    //stomp.ConnOpt.HeartBeat(time.Millisecond, time.Millisecond),
   }
 
-  conn, err := stomp.Dial("tcp", mani.Uri, opts...)
+  if u.Scheme != "stomp+ssl" {
+    return stomp.Dial("tcp", u.Host, opts...)
+  }
+
+  cfg := &tls.Config{}
+  if s.mani.Tls != nil {
+    if cfg, err = s.mani.Tls.Config(); err != nil {
+      return nil, fmt.Errorf("invalid tls config: %v", err)
+    }
+  }
+
+  conn, err := tls.Dial("tcp", u.Host, cfg)
+  if err != nil { return nil, err }
+
+  ret, err := stomp.Connect(conn, opts...)
   if err != nil {
-    glog.Error(err)
-    return
+    conn.Close()
+    return nil, err
   }
-  glog.Info("Server version: ", conn.Version)
+  return ret, nil
+}
+
+// Connect and serve subscriptions until context is done, reconnect with
+// backoff if connection drops
+func (s *Sub) StartSub(ctx context.Context) {
+  glog.Infof("%s", common.CurrentScope())
 
-  s.sub, err = conn.Subscribe(mani.Queues[common.TopicUpdateManifest], stomp.AckAuto)
+  max, err := time.ParseDuration(ReconnectMax)
   if err != nil {
-    glog.Error(err)
-    return
+    glog.Errorf("invalid STOMP_RECONNECT_MAX: %v", err)
+    max = 2 * time.Minute
   }
 
-  defer conn.Disconnect()
-  defer s.sub.Unsubscribe()
-  s.run()
+  backoff := time.Second
+  for {
+    err := s.serve(ctx)
+    if ctx.Err() != nil { return }
+
+    if err == nil {
+      backoff = time.Second
+    }
+    glog.Errorf("stomp connection lost, reconnect in %v: %v", backoff, err)
+
+    select {
+    case <-ctx.Done():
+      return
+    case <-time.After(backoff):
+    }
+    if backoff *= 2; backoff > max {
+      backoff = max
+    }
+  }
 }
 
-func (s *Sub) run() {
-  for {
-    msg := <-s.sub.C
+func (s *Sub) setConn(conn *stomp.Conn) {
+  s.conn_mutex.Lock()
+  s.conn = conn
+  s.conn_mutex.Unlock()
+}
+
+func (s *Sub) serve(ctx context.Context) error {
+  conn, err := s.dial()
+  if err != nil { return err }
+  glog.Info("Server version: ", conn.Version())
+
+  errc := make(chan error, len(s.topics))
+  for _, topic := range s.topics {
+    sub, err := conn.Subscribe(topic, stomp.AckAuto)
+    if err != nil {
+      conn.Disconnect()
+      return fmt.Errorf("subscribe %s failed: %v", topic, err)
+    }
+    defer sub.Unsubscribe()
+    go s.run(sub, errc)
+  }
+
+  s.setConn(conn)
+  s.pubPresence(common.PresenceOnline)
+
+  select {
+  case <-ctx.Done():
+    s.pubPresence(common.PresenceOffline)
+  case err = <-errc:
+  }
+
+  s.setConn(nil)
+  conn.Disconnect()
+  return err
+}
+
+func (s *Sub) run(sub *stomp.Subscription, errc chan<- error) {
+  for msg := range sub.C {
     if msg.Err != nil {
-      glog.Errorf("failed to recieve msg: %v", msg.Err)
-      continue
+      errc <- fmt.Errorf("failed to recieve msg: %v", msg.Err)
+      return
     }
     s.on_message(msg)
   }
 }
 
-// subscribe to update manifest
-func (s *Sub) StartSub() {
-  glog.Infof("%s", common.CurrentScope())
-  mani, err := manifest.LoadSubMani()
-  if err != nil {
-    glog.Error("load subscribe manifest failed: ", err)
-    return
+// Subscribed with auto ack, message not processed by handler is not
+// delivered again
+func (s *Sub) on_message(msg *stomp.Message) {
+  glog.Infof("%s (%v)", common.CurrentScope(), msg.Destination)
+
+  if err := s.MsgHandler.Handle(msg.Destination, msg.Body); err != nil {
+    glog.Errorf("message on %s not processed, not delivered again: %v", msg.Destination, err)
+  }
+}
+
+// Send to destination, there is no outbox, messages published while
+// disconnected are dropped
+func (s *Sub) send(dest string, data []byte) error {
+  s.conn_mutex.Lock()
+  defer s.conn_mutex.Unlock()
+
+  if dest == "" {
+    return fmt.Errorf("destination not defined")
   }
 
-  s.subUpdate(mani)
+  if s.conn == nil {
+    return fmt.Errorf("not connected, dropped message to %s", dest)
+  }
+  return s.conn.Send(dest, ContentType, data)
 }
 
-func (s *Sub) on_message(msg *stomp.Message) {
-  glog.Infof("%s (%v)", common.CurrentScope(), string(msg.Body))
+// Connect once and send data to each destination, used by publisher
+func (s *Sub) PushAll(topics []string, data []byte) (map[string]error, error) {
+  glog.Infof("%s (%d destination(s))", common.CurrentScope(), len(topics))
 
-  s.MsgHandler.Handle(msg)
+  conn, err := s.dial()
+  if err != nil { return nil, err }
+  defer conn.Disconnect()
+
+  errs := make(map[string]error)
+  for _, topic := range topics {
+    if err := conn.Send(topic, ContentType, data); err != nil {
+      errs[topic] = err
+    }
+  }
+  return errs, nil
+}
+
+func (s *Sub) Publish(key string, data []byte) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), key)
+  return s.send(s.Topic(key), data)
+}
+
+func (s *Sub) PublishEvent(data []byte) error {
+  glog.Infof("%s", common.CurrentScope())
+  return s.send(s.Topic(common.TopicEvent), data)
+}
+
+func (s *Sub) PublishHeartbeat(data []byte) error {
+  glog.Infof("%s", common.CurrentScope())
+  return s.send(s.Topic(common.TopicHeartbeat), data)
+}
+
+// STOMP has neither retained messages nor last will, presence is sent as is
+func (s *Sub) PublishPresence(p *common.Presence) error {
+  topic := s.Topic(common.TopicStatus)
+  if topic == "" { return nil }
+  return s.send(topic, p.Encode())
+}
+
+func (s *Sub) pubPresence(state common.PresenceState) {
+  if err := s.PublishPresence(common.NewPresence(state)); err != nil {
+    glog.Errorf("failed to publish presence: %v", err)
+  }
 }
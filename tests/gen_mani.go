@@ -7,6 +7,11 @@ import (
   "os"
   "net/url"
   "strconv"
+  "io/ioutil"
+  "crypto/rand"
+  "crypto/ed25519"
+  "crypto/x509"
+  "encoding/pem"
   mq "github.com/zex/container-update/mqtt"
   "github.com/zex/container-update/manifest"
   "github.com/zex/container-update/common"
@@ -15,10 +20,32 @@ import (
 
 var (
   G *gen.Gen
+  SignKey = flag.String("key", "", "PEM private key to sign update manifest with")
 )
 
+// TLS settings from env, PEM files are embedded if SUB_TLS_EMBED is set
+func newTlsConfig() *manifest.TlsConfig {
+  ret := &manifest.TlsConfig{
+    Ca: os.Getenv("SUB_TLS_CA"),
+    Cert: os.Getenv("SUB_TLS_CERT"),
+    Key: os.Getenv("SUB_TLS_KEY"),
+    ServerName: os.Getenv("SUB_TLS_SERVER_NAME"),
+  }
+  ret.InsecureSkipVerify, _ = strconv.ParseBool(os.Getenv("SUB_TLS_INSECURE"))
+
+  if *ret == (manifest.TlsConfig{}) {
+    return nil
+  }
+
+  if embed, _ := strconv.ParseBool(os.Getenv("SUB_TLS_EMBED")); embed {
+    if err := ret.Embed(); err != nil { panic(err) }
+  }
+  return ret
+}
+
 func newSubMani() *manifest.SubManifest{
   return &manifest.SubManifest{
+    Tls: newTlsConfig(),
     Uri: os.Getenv("SUB_URI"),
     Cred: manifest.Credential{
       User: os.Getenv("SUB_USER"),
@@ -27,7 +54,11 @@ func newSubMani() *manifest.SubManifest{
     Topics: map[string]string {
       common.TopicUpdateManifest: fmt.Sprintf("%s/%s", common.TopicUpdateManifest, os.Getenv("ID")),
       common.TopicEvent: fmt.Sprintf("%s/%s", common.TopicEvent, os.Getenv("ID")),
-      common.TopicHeartbeat: fmt.Sprintf("%s/%s", common.TopicHeartbeat, os.Getenv("ID")) },}
+      common.TopicHeartbeat: fmt.Sprintf("%s/%s", common.TopicHeartbeat, os.Getenv("ID")),
+      common.TopicActivate: fmt.Sprintf("%s/%s", common.TopicActivate, os.Getenv("ID")),
+      common.TopicStatus: fmt.Sprintf("%s/%s", common.TopicStatus, os.Getenv("ID")),
+      common.TopicCommand: fmt.Sprintf("%s/%s", common.TopicCommand, os.Getenv("ID")),
+      common.TopicReply: fmt.Sprintf("%s/%s", common.TopicReply, os.Getenv("ID")) },}
 }
 
 func gen_sub_mani() {
@@ -60,6 +91,20 @@ func gen_asset_mani() {
 func newUpdateManifest() *manifest.UpdateManifest {
   ret := &manifest.UpdateManifest{
     CreatedAt: time.Now(),}
+  ret.PlanOnly, _ = strconv.ParseBool(os.Getenv("PLAN_ONLY"))
+  ret.WaitActivate, _ = strconv.ParseBool(os.Getenv("WAIT_ACTIVATE"))
+  if at := os.Getenv("ACTIVATE_AT"); at != "" {
+    t, err := time.Parse(time.RFC3339, at)
+    if err != nil { panic(err) }
+    ret.ActivateAt = t
+  }
+  if cron := os.Getenv("WINDOW_CRON"); cron != "" {
+    ret.Window = &manifest.MaintWindow{
+      Cron: cron,
+      Duration: os.Getenv("WINDOW_DURATION"),
+      Timezone: os.Getenv("WINDOW_TZ"),
+    }
+  }
   var image_name string
 
   if e, _ := strconv.ParseBool(os.Getenv("ENABLE_UPDATED")); e {
@@ -80,15 +125,35 @@ func newUpdateManifest() *manifest.UpdateManifest {
     image_name = fmt.Sprintf("application/%s_x", os.Getenv("MAJOR_VERSION"))
     comp_ := G.NewAppComp(image_name, os.Getenv("APP_VERSION"))
     if comp_ == nil { panic("invalid component application") }
+    if e, _ := strconv.ParseBool(os.Getenv("ENABLE_DB")); e {
+      comp_.DependsOn = append(comp_.DependsOn, gen.COMP_DB)
+    }
     ret.Components = append(ret.Components, *comp_)
   }
 
   return ret
 }
 
+func sign_mani(mani *manifest.UpdateManifest) (*manifest.Envelope, error) {
+  key, err := manifest.LoadPrivateKey(*SignKey)
+  if err != nil {
+    return nil, err
+  }
+  return manifest.Seal(key, manifest.ENVELOPE_UPDATE, mani)
+}
+
 func gen_update_mani() error {
   mani := newUpdateManifest()
-  data, err := mani.Encode()
+  encode := mani.Encode
+  if len(*SignKey) > 0 {
+    env, err := sign_mani(mani)
+    if err != nil {
+      return err
+    }
+    encode = env.Encode
+  }
+
+  data, err := encode()
   if err != nil {
     return err
   }
@@ -155,6 +220,16 @@ func dec_sub_mani(data *string) {
 }
 
 func dec_update_mani(data *string) {
+  if env, err := manifest.ParseEnvelope([]byte(*data)); err == nil {
+    mani, err := manifest.ParseUpdateMani(env.Payload)
+    if err != nil {
+      fmt.Println("decode mani failed: ", err)
+      return
+    }
+    fmt.Println(*mani)
+    return
+  }
+
   mani := &manifest.UpdateManifest{}
   if err := mani.Decode(*data); err != nil {
     fmt.Println("decode mani failed: ", err)
@@ -176,12 +251,78 @@ func decode(op_dec, data *string) {
     }
 }
 
+// sign encoded update manifest
+func sign(data *string) {
+  mani := &manifest.UpdateManifest{}
+  if err := mani.Decode(*data); err != nil {
+    fmt.Println("decode mani failed: ", err)
+    return
+  }
+
+  env, err := sign_mani(mani)
+  if err != nil {
+    fmt.Println("sign mani failed: ", err)
+    return
+  }
+
+  enc, err := env.Encode()
+  if err != nil { panic(err) }
+  fmt.Println(enc)
+}
+
+// verify encoded signed update manifest
+func verify(pub_path, data *string) {
+  env, err := manifest.ParseEnvelope([]byte(*data))
+  if err != nil {
+    fmt.Println("decode mani failed: ", err)
+    return
+  }
+
+  keys, err := manifest.LoadPublicKeys(*pub_path)
+  if err != nil {
+    fmt.Println("load keys failed: ", err)
+    return
+  }
+
+  if _, err := env.UpdateManifest(keys); err != nil {
+    fmt.Println("verify failed: ", err)
+    return
+  }
+  fmt.Println("verified")
+}
+
+// generate Ed25519 key pair as <prefix>.key and <prefix>.pem
+func gen_key(prefix *string) {
+  pub, priv, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil { panic(err) }
+
+  priv_der, err := x509.MarshalPKCS8PrivateKey(priv)
+  if err != nil { panic(err) }
+
+  pub_der, err := x509.MarshalPKIXPublicKey(pub)
+  if err != nil { panic(err) }
+
+  if err := ioutil.WriteFile(*prefix + ".key", pem.EncodeToMemory(
+      &pem.Block{Type: "PRIVATE KEY", Bytes: priv_der}), 0600); err != nil {
+    panic(err)
+  }
+
+  if err := ioutil.WriteFile(*prefix + ".pem", pem.EncodeToMemory(
+      &pem.Block{Type: "PUBLIC KEY", Bytes: pub_der}), 0644); err != nil {
+    panic(err)
+  }
+  fmt.Printf("%s.key %s.pem\n", *prefix, *prefix)
+}
+
 func main() {
   var (
     op_enc = flag.String("encode", "", "Manifest type, ['asset','sub','update','latest']")
     op_dec = flag.String("decode", "", "Manifest type, ['asset','sub','update','latest']")
     op_latest = flag.Bool("latest", false, "Get latest image tag")
     data = flag.String("data", "", "Manifest data to decode")
+    op_sign = flag.Bool("sign", false, "Sign update manifest given by -data with -key")
+    op_verify = flag.String("verify", "", "Verify update manifest given by -data with public key(s)")
+    op_genkey = flag.String("genkey", "", "Generate Ed25519 key pair with given path prefix")
   )
 
   flag.Parse()
@@ -191,6 +332,12 @@ func main() {
     encode(op_enc)
   } else if (len(*op_dec)) > 0 {
     decode(op_dec, data)
+  } else if *op_sign {
+    sign(data)
+  } else if len(*op_verify) > 0 {
+    verify(op_verify, data)
+  } else if len(*op_genkey) > 0 {
+    gen_key(op_genkey)
   } else if *op_latest {
     fmt.Println(G.LatestTag(*gen.ImgName))
   }
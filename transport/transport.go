@@ -0,0 +1,38 @@
+package transport
+
+import (
+  "fmt"
+  "net/url"
+
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/manifest"
+  mq "github.com/zex/container-update/mqtt"
+  "github.com/zex/container-update/stomp"
+  "github.com/zex/container-update/amqp"
+)
+
+// Transport for broker given in subscription manifest, chosen by uri scheme
+func NewTransport(h common.MsgHandler, mani *manifest.SubManifest) (common.Transport, error) {
+  u, err := url.Parse(mani.Uri)
+  if err != nil {
+    return nil, fmt.Errorf("invalid uri: %v", err)
+  }
+
+  switch u.Scheme {
+  case "tcp", "ssl", "tls", "tcps", "ws", "wss", "mqtt", "mqtts":
+    return mq.NewSub(h, mani), nil
+  case "stomp", "stomp+ssl":
+    return stomp.NewSub(h, mani), nil
+  case "amqp", "amqps":
+    return amqp.NewSub(h, mani), nil
+  default:
+    return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+  }
+}
+
+// Transport from SUB_MANIFEST
+func LoadTransport(h common.MsgHandler) (common.Transport, error) {
+  mani, err := manifest.LoadSubMani()
+  if err != nil { return nil, err }
+  return NewTransport(h, mani)
+}
@@ -0,0 +1,290 @@
+package updater
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "strings"
+  "strconv"
+  "crypto"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "github.com/golang/glog"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+)
+
+const (
+  ACTION_RESTART_COMPONENT = "restart-component"
+  ACTION_PRUNE_IMAGES = "prune-images"
+  ACTION_DB_MIGRATE = "db-migrate"
+  ACTION_ROLLBACK = "rollback"
+  ACTION_COLLECT_LOGS = "collect-logs"
+
+  ACTION_VIA_BUS = "bus"
+  ACTION_VIA_API = "api"
+)
+
+var (
+  // actions that may be invoked, comma separated
+  ACTIONS_ALLOWED = common.GetEnvOr("ACTIONS_ALLOWED",
+    "restart-component,prune-images,rollback,collect-logs")
+  // PEM public keys authorized for all actions, keys in subdirectory named
+  // by action are authorized for that action only
+  ACTION_KEYS = os.Getenv("ACTION_KEYS")
+  // requests older than this are refused, also how long ids are remembered
+  ACTION_MAX_AGE = common.GetEnvOr("ACTION_MAX_AGE", "5m")
+)
+
+type actionFn func(self *Daemon, args json.RawMessage) (interface{}, error)
+
+var actions = map[string]actionFn {
+  ACTION_RESTART_COMPONENT: (*Daemon).actRestartComponent,
+  ACTION_PRUNE_IMAGES: (*Daemon).actPruneImages,
+  ACTION_DB_MIGRATE: (*Daemon).actDbMigrate,
+  ACTION_ROLLBACK: (*Daemon).actRollback,
+  ACTION_COLLECT_LOGS: (*Daemon).actCollectLogs,
+}
+
+// Payload of audit event, one when action is refused or started and one
+// when it's done
+type Audit struct {
+  Id string `json:"id"`
+  Action string `json:"action"`
+  Requester string `json:"requester,omitempty"`
+  Via string `json:"via"`
+  Outcome string `json:"outcome"`
+  Error string `json:"error,omitempty"`
+}
+
+func actionAllowed(name string) bool {
+  for _, allowed := range strings.Split(ACTIONS_ALLOWED, ",") {
+    if strings.TrimSpace(allowed) == name { return true }
+  }
+  return false
+}
+
+// Load keys authorized for each action
+func (self *Daemon) loadActionKeys() {
+  glog.Infof("%s", common.CurrentScope())
+
+  self.action_keys = make(map[string][]crypto.PublicKey)
+  if ACTION_KEYS == "" {
+    glog.Info("ACTION_KEYS not defined, all actions will be refused")
+    return
+  }
+
+  shared, err := manifest.LoadPublicKeys(ACTION_KEYS)
+  if err != nil {
+    glog.Errorf("failed to load action keys: %v", err)
+    return
+  }
+
+  for name := range actions {
+    keys := append([]crypto.PublicKey(nil), shared...)
+    dir := filepath.Join(ACTION_KEYS, name)
+    if _, err := os.Stat(dir); err == nil {
+      own, err := manifest.LoadPublicKeys(dir)
+      if err != nil {
+        glog.Errorf("failed to load keys of %s: %v", name, err)
+        continue
+      }
+      keys = append(keys, own...)
+    }
+    self.action_keys[name] = keys
+  }
+}
+
+// Keys authorized for any action
+func (self *Daemon) anyActionKeys() []crypto.PublicKey {
+  var ret []crypto.PublicKey
+  for _, keys := range self.action_keys {
+    ret = append(ret, keys...)
+  }
+  return ret
+}
+
+// Open action request sealed in envelope, refuse it if not of the expected
+// action when given, not whitelisted, for another device, stale, replayed or
+// not signed by a key authorized for the action
+func (self *Daemon) authorize(env *manifest.Envelope, action string) (*manifest.ActionRequest, error) {
+  // payload is looked at only once signed by a known key
+  payload, err := env.Open(manifest.ENVELOPE_ACTION, self.anyActionKeys())
+  if err != nil {
+    return nil, fmt.Errorf("action request rejected: %v", err)
+  }
+
+  var req manifest.ActionRequest
+  if err := json.Unmarshal(payload, &req); err != nil {
+    return nil, fmt.Errorf("invalid action request: %v", err)
+  }
+
+  if action != "" && req.Action != action {
+    return &req, fmt.Errorf("action request is %s, not %s", req.Action, action)
+  }
+
+  if _, ok := actions[req.Action]; !ok {
+    return &req, fmt.Errorf("unknown action: %s", req.Action)
+  }
+
+  if !actionAllowed(req.Action) {
+    return &req, fmt.Errorf("action not allowed: %s", req.Action)
+  }
+
+  if req.Id == "" {
+    return &req, fmt.Errorf("action request without id")
+  }
+
+  if req.Device != common.DeviceId() {
+    return &req, fmt.Errorf("action request is for device %q", req.Device)
+  }
+
+  max_age, err := time.ParseDuration(ACTION_MAX_AGE)
+  if err != nil {
+    return &req, fmt.Errorf("invalid ACTION_MAX_AGE: %v", err)
+  }
+
+  if age := time.Since(req.CreatedAt); age > max_age || age < -max_age {
+    return &req, fmt.Errorf("action request created at %v is out of date", req.CreatedAt)
+  }
+
+  if _, err := env.Open(manifest.ENVELOPE_ACTION, self.action_keys[req.Action]); err != nil {
+    return &req, fmt.Errorf("not authorized for %s: %v", req.Action, err)
+  }
+
+  self.seen_mutex.Lock()
+  defer self.seen_mutex.Unlock()
+
+  now := time.Now()
+  for id, at := range self.seen {
+    if now.Sub(at) > 2 * max_age { delete(self.seen, id) }
+  }
+
+  if _, ok := self.seen[req.Id]; ok {
+    return &req, fmt.Errorf("action request %s already seen", req.Id)
+  }
+  self.seen[req.Id] = now
+  return &req, nil
+}
+
+// Run maintenance action sealed in envelope once authorized, action must be
+// the given one if not empty, invocation is audited through event topic
+func (self *Daemon) RunAction(env *manifest.Envelope, action, via string) (interface{}, error) {
+  glog.Infof("%s (%s)", common.CurrentScope(), via)
+
+  // refused before it's marked as seen, so that it can be delivered again
+  if self.ctx.Err() != nil {
+    return nil, ErrStopping
+  }
+
+  req, err := self.authorize(env, action)
+  audit := &Audit{Via: via}
+  if req != nil {
+    audit.Id, audit.Action, audit.Requester = req.Id, req.Action, req.Requester
+  }
+
+  if err != nil {
+    audit.Outcome, audit.Error = "refused", err.Error()
+    self.pubAudit(audit)
+    return nil, err
+  }
+
+  // no action while a manifest is being set up
+  self.apply_mutex.Lock()
+  defer self.apply_mutex.Unlock()
+
+  if self.ctx.Err() != nil {
+    return nil, ErrStopping
+  }
+
+  audit.Outcome = "started"
+  self.pubAudit(audit)
+
+  ret, err := actions[req.Action](self, req.Args)
+  audit.Outcome = "succeeded"
+  if err != nil {
+    audit.Outcome, audit.Error = "failed", err.Error()
+  }
+  self.pubAudit(audit)
+  return ret, err
+}
+
+func (self *Daemon) pubAudit(audit *Audit) {
+  glog.Infof("%s (%s: %s)", common.CurrentScope(), audit.Action, audit.Outcome)
+
+  data, err := json.Marshal(audit)
+  if err != nil {
+    glog.Errorf("failed to encode audit: %v", err)
+    return
+  }
+
+  ev := common.NewEvent()
+  ev.Publisher = self.sub
+  ev.Ty = common.EventTypeAudit
+  ev.Payload = string(data)
+  if err := ev.Publish(); err != nil {
+    glog.Errorf("failed to publish audit: %v", err)
+  }
+}
+
+func (self *Daemon) actRestartComponent(args json.RawMessage) (interface{}, error) {
+  comp, err := parseCompArgs(args)
+  if err != nil { return nil, err }
+
+  return nil, self.adapt.RestartContainer(self.containerOf(comp.Component))
+}
+
+// Called with apply_mutex held by RunAction
+func (self *Daemon) actRollback(args json.RawMessage) (interface{}, error) {
+  comp, err := parseCompArgs(args)
+  if err != nil { return nil, err }
+
+  return self.rollback(comp.Component)
+}
+
+func (self *Daemon) actCollectLogs(args json.RawMessage) (interface{}, error) {
+  comp, err := parseCompArgs(args)
+  if err != nil { return nil, err }
+
+  if comp.Tail <= 0 {
+    comp.Tail = LOGS_TAIL_DEFAULT
+  }
+
+  ret := &LogsResult{
+    Component: comp.Component,
+    ContainerName: self.containerOf(comp.Component),
+  }
+
+  logs, err := self.adapt.ContainerLogs(ret.ContainerName, strconv.Itoa(comp.Tail))
+  if err != nil { return nil, err }
+
+  // keep the latest output
+  if len(logs) > LOGS_MAX {
+    logs, ret.Truncated = logs[len(logs) - LOGS_MAX:], true
+  }
+  ret.Logs = logs
+  return ret, nil
+}
+
+func (self *Daemon) actPruneImages(args json.RawMessage) (interface{}, error) {
+  return self.adapt.PruneImages()
+}
+
+// Run migration script UPDATE_SQL_PATH against local database, no SQL is
+// taken from request
+func (self *Daemon) actDbMigrate(args json.RawMessage) (interface{}, error) {
+  sql_path := os.Getenv("UPDATE_SQL_PATH")
+  if sql_path == "" {
+    return nil, fmt.Errorf("UPDATE_SQL_PATH not defined")
+  }
+
+  pass, err := ioutil.ReadFile(os.Getenv("DB_KEY"))
+  if err != nil {
+    return nil, fmt.Errorf("failed to read DB_KEY: %v", err)
+  }
+
+  return nil, common.NativeMysql(os.Getenv("DB_LOGIN"), os.Getenv("DB_HOST"),
+    os.Getenv("DB_PORT"), strings.TrimSpace(string(pass)), sql_path)
+}
@@ -0,0 +1,102 @@
+package updater
+
+import (
+  "sync"
+  "time"
+  "strings"
+  "testing"
+  "crypto"
+  "crypto/rand"
+  "crypto/ed25519"
+  "github.com/zex/container-update/manifest"
+)
+
+func genKey(t *testing.T) (crypto.PublicKey, crypto.Signer) {
+  pub, priv, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil { t.Fatal(err) }
+  return pub, priv
+}
+
+func TestAuthorize(t *testing.T) {
+  t.Setenv("DEVICE_ID", "dev1")
+
+  shared_pub, shared := genKey(t)
+  prune_pub, prune := genKey(t)
+  _, stranger := genKey(t)
+
+  daemon := &Daemon{
+    seen_mutex: &sync.Mutex{},
+    seen: make(map[string]time.Time),
+    action_keys: map[string][]crypto.PublicKey{
+      ACTION_RESTART_COMPONENT: {shared_pub},
+      ACTION_PRUNE_IMAGES: {shared_pub, prune_pub},
+      ACTION_DB_MIGRATE: {shared_pub},
+    },
+  }
+
+  n := 0
+  request := func(action string) *manifest.ActionRequest {
+    n++
+    return &manifest.ActionRequest{
+      Id: strings.Repeat("x", n),
+      Action: action,
+      Device: "dev1",
+      CreatedAt: time.Now(),
+    }
+  }
+  seal := func(key crypto.Signer, ty string, req *manifest.ActionRequest) *manifest.Envelope {
+    env, err := manifest.Seal(key, ty, req)
+    if err != nil { t.Fatal(err) }
+    return env
+  }
+
+  accepted := seal(shared, manifest.ENVELOPE_ACTION, request(ACTION_RESTART_COMPONENT))
+  if _, err := daemon.authorize(accepted, ""); err != nil {
+    t.Fatalf("valid request refused: %v", err)
+  }
+  if _, err := daemon.authorize(accepted, ""); err == nil {
+    t.Errorf("replayed request accepted")
+  }
+
+  // key of one action is good for that action only
+  if _, err := daemon.authorize(seal(prune, manifest.ENVELOPE_ACTION,
+      request(ACTION_PRUNE_IMAGES)), ""); err != nil {
+    t.Errorf("action key refused for its action: %v", err)
+  }
+
+  stale := request(ACTION_RESTART_COMPONENT)
+  stale.CreatedAt = time.Now().Add(-time.Hour)
+  other := request(ACTION_RESTART_COMPONENT)
+  other.Device = "dev2"
+  no_id := request(ACTION_RESTART_COMPONENT)
+  no_id.Id = ""
+
+  tests := []struct {
+    name string
+    env *manifest.Envelope
+    action string
+  }{
+    {"unknown key", seal(stranger, manifest.ENVELOPE_ACTION, request(ACTION_RESTART_COMPONENT)), ""},
+    {"key of other action", seal(prune, manifest.ENVELOPE_ACTION, request(ACTION_RESTART_COMPONENT)), ""},
+    {"signed as update manifest", seal(shared, manifest.ENVELOPE_UPDATE, request(ACTION_RESTART_COMPONENT)), ""},
+    {"not the expected action", seal(shared, manifest.ENVELOPE_ACTION, request(ACTION_RESTART_COMPONENT)), ACTION_ROLLBACK},
+    {"not allowed", seal(shared, manifest.ENVELOPE_ACTION, request(ACTION_DB_MIGRATE)), ""},
+    {"unknown action", seal(shared, manifest.ENVELOPE_ACTION, request("reboot")), ""},
+    {"stale", seal(shared, manifest.ENVELOPE_ACTION, stale), ""},
+    {"other device", seal(shared, manifest.ENVELOPE_ACTION, other), ""},
+    {"without id", seal(shared, manifest.ENVELOPE_ACTION, no_id), ""},
+  }
+
+  for _, tt := range tests {
+    if _, err := daemon.authorize(tt.env, tt.action); err == nil {
+      t.Errorf("%s: accepted", tt.name)
+    }
+  }
+
+  // tampered payload
+  env := seal(shared, manifest.ENVELOPE_ACTION, request(ACTION_RESTART_COMPONENT))
+  env.Payload = []byte(strings.Replace(string(env.Payload), "dev1", "dev2", 1))
+  if _, err := daemon.authorize(env, ""); err == nil {
+    t.Errorf("tampered request accepted")
+  }
+}
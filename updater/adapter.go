@@ -4,6 +4,10 @@ import (
   "fmt"
   "os"
   "io"
+  "bytes"
+  "time"
+  "sync"
+  "strings"
   "context"
   "encoding/json"
   "encoding/base64"
@@ -11,8 +15,8 @@ import (
 	"github.com/docker/docker/pkg/parsers/operatingsystem"
   "github.com/docker/docker/api/types"
   "github.com/docker/docker/api/types/filters"
+  "github.com/docker/docker/pkg/stdcopy"
   //"github.com/docker/docker/libcontainerd"
-	"github.com/containerd/containerd"
   docker "github.com/docker/docker/client"
 
   "github.com/zex/container-update/manifest"
@@ -30,13 +34,23 @@ func detectEnv() error {
 
 type DockerAdapter struct {
   ctx context.Context
+  // canceled on shutdown, interrupts only what's safe to abandon
+  stop context.Context
   cli *docker.Client
+  pub common.Publisher
+  // image refs pulled ahead of setup
+  staged_mutex *sync.Mutex
+  staged map[string]bool
 }
 
-func NewDockerAdapter() *DockerAdapter {
+func NewDockerAdapter(stop context.Context, pub common.Publisher) *DockerAdapter {
   var err error
   ret := &DockerAdapter{
     ctx: context.Background(),
+    stop: stop,
+    pub: pub,
+    staged_mutex: &sync.Mutex{},
+    staged: make(map[string]bool),
   }
 
   if ret.cli, err = docker.NewEnvClient(); err != nil {
@@ -45,6 +59,18 @@ func NewDockerAdapter() *DockerAdapter {
   return ret
 }
 
+var (
+  // time to wait for a new container to prove it keeps running
+  StartupGrace = common.GetEnvOr("STARTUP_GRACE", "10s")
+  // time to wait for a container to stop before it's killed
+  StopTimeout = "10s"
+)
+
+const (
+  // tag previous image of component is kept by until next update
+  PREV_TAG = "updater-prev"
+)
+
 func containerBackupName(name string) string {
   return fmt.Sprintf("%s-prev", name)
 }
@@ -59,35 +85,43 @@ func (self *DockerAdapter) SetupContainer(
     return nil
   }
 
-  if err := self.FetchImage(comp); err != nil {
+  if self.ImageStaged(comp) {
+    glog.Infof("%s: image staged", comp.Name)
+  } else if err := self.FetchImage(comp); err != nil {
     return fmt.Errorf("failed to pull image: %v", err)
   }
 
-  prev, err := self.GetContainersByName(comp.ContainerName)
+  prev, err := self.BackupContainer(comp)
   if err != nil {
-    glog.Infof("faile to list container: %v", err)
+    return fmt.Errorf("failed to backup container: %v", err)
   }
 
-  if prev != nil {
-    if err := self.CleanupContainer(prev); err != nil {
-      glog.Errorf("failed to cleanup previous container: %v", err)
-    }
+  if err := self.StartContainer(comp); err != nil {
+    return self.rollback(comp, prev, fmt.Errorf("failed to start container: %v", err))
   }
 
-  /**
-  prev, err := self.BackupContainer(comp)
-  if err != nil {
-    return err
+  if err := self.WaitStarted(comp); err != nil {
+    return self.rollback(comp, prev, err)
   }
-  */
 
-  if err := self.StartContainer(comp); err != nil {
-    return fmt.Errorf("failed to start container: %v", err)
+  if err := self.WaitHealthy(comp); err != nil {
+    return self.rollback(comp, prev, err)
   }
 
-  if prev != nil && prev.Image != comp.ContainerConfig.Image {
-    if err := self.CleanupImage(prev); err != nil {
-      glog.Errorf("failed to cleanup previous image: %v", err)
+  self.unstage(comp)
+
+  // new container confirmed, previous one is not needed anymore, its image
+  // is kept for rollback
+  if prev != nil {
+    if err := self.CleanupContainer(prev); err != nil {
+      glog.Errorf("failed to cleanup previous container: %v", err)
+    }
+
+    cur, err := self.GetContainersByName(comp.ContainerName)
+    if err == nil && cur != nil && prev.ImageID != cur.ImageID {
+      if err := self.keepPrevImage(comp, prev, cur); err != nil {
+        glog.Errorf("failed to keep previous image: %v", err)
+      }
     }
   }
 
@@ -95,6 +129,21 @@ func (self *DockerAdapter) SetupContainer(
   return nil
 }
 
+// Restore previous container after a failed setup, cause is returned with rollback result
+func (self *DockerAdapter) rollback(comp *manifest.Component,
+  prev *types.Container, cause error) error {
+  glog.Errorf("%s: %v", comp.Name, cause)
+
+  if err := self.RestoreContainer(comp, prev); err != nil {
+    return fmt.Errorf("%v, rollback failed: %v", cause, err)
+  }
+
+  if prev == nil {
+    return cause
+  }
+  return fmt.Errorf("%v, rolled back to %s", cause, prev.Image)
+}
+
 func (self *DockerAdapter) performPostOp(comp *manifest.Component,
   funcs... PostSetupFn) {
   glog.Infof("%s", common.CurrentScope())
@@ -165,13 +214,14 @@ func (self *DockerAdapter) getAuthStr(comp *manifest.Component) (string, error)
   return base64.URLEncoding.EncodeToString(auth_json), nil
 }
 
-func (self *DockerAdapter) FetchImage(comp *manifest.Component) error {
+func (self *DockerAdapter) pullImage(ctx context.Context, comp *manifest.Component) error {
   glog.Infof("%s", common.CurrentScope())
 
   auth_str, err := self.getAuthStr(comp)
   if err != nil { return err }
 
-  body, err := self.cli.ImagePull(self.ctx, comp.ContainerConfig.Image, types.ImagePullOptions{
+  ref := comp.ImageRef()
+  body, err := self.cli.ImagePull(ctx, ref, types.ImagePullOptions{
     //All: true,
 		RegistryAuth: auth_str,
   })
@@ -179,10 +229,38 @@ func (self *DockerAdapter) FetchImage(comp *manifest.Component) error {
   if err != nil { return err }
   defer body.Close()
 
-  io.Copy(os.Stdout, body)
+  tracker := newPullTracker(self.pub, comp, ref)
+  if err := tracker.Read(body); err != nil {
+    return err
+  }
+
+  if comp.ImageDigest != "" {
+    return self.VerifyImageDigest(comp, ref)
+  }
+  return nil
+}
+
+// Check local image given by ref has digest pinned in component
+func (self *DockerAdapter) VerifyImageDigest(comp *manifest.Component, ref string) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), ref)
+
+  info, _, err := self.cli.ImageInspectWithRaw(self.ctx, ref)
+  if err != nil { return err }
+
+  if !hasDigest(info.RepoDigests, comp.ImageDigest) {
+    return fmt.Errorf("%s: image digest mismatch, want %s, got %v",
+      comp.Name, comp.ImageDigest, info.RepoDigests)
+  }
   return nil
 }
 
+func hasDigest(repo_digests []string, digest string) bool {
+  for _, d := range repo_digests {
+    if strings.HasSuffix(d, "@" + digest) { return true }
+  }
+  return false
+}
+
 func (self *DockerAdapter) DeprecateComponent(comp *manifest.Component) {
   glog.Infof("%s", common.CurrentScope())
 
@@ -237,12 +315,11 @@ func (self *DockerAdapter) GetContainersByName(name string) (*types.Container, e
     }
   }
 
-  return nil, fmt.Errorf("%s: container not found", name)
+  return nil, nil
 }
 
 func (self *DockerAdapter) NeedUpdate(comp *manifest.Component) bool {
   glog.Infof("%s", common.CurrentScope())
-  var err error
   if comp.Force { return true }
 
   if comp.Op == manifest.COMPOP_DEPRECATE {
@@ -250,16 +327,11 @@ func (self *DockerAdapter) NeedUpdate(comp *manifest.Component) bool {
     return false
   }
 
-  cont, err := self.GetContainersByName(comp.ContainerName)
-  if err != nil {
-    glog.Errorf("faile to list container: %s", err)
-    return true
+  plan := self.PlanComponent(comp)
+  if plan.Error != "" {
+    glog.Errorf("%s: %s", comp.Name, plan.Error)
   }
-
-  if cont == nil { return true }
-  if cont.State != string(containerd.Running) { return true }
-  if cont.Image == comp.ContainerConfig.Image { return false }
-  return true
+  return plan.NeedUpdate()
 }
 
 func (self *DockerAdapter) ListContainers() ([]types.Container, error) {
@@ -278,6 +350,62 @@ func (self *DockerAdapter) ListImages() ([]types.ImageSummary, error) {
   return images, nil
 }
 
+// Local reference previous image of component is kept by
+func prevImageRef(comp *manifest.Component) string {
+  return fmt.Sprintf("%s:%s", comp.ImageRepo(), PREV_TAG)
+}
+
+// Tag image of previous container as PREV_TAG, the image kept by the tag
+// before and the previous tag are removed
+func (self *DockerAdapter) keepPrevImage(comp *manifest.Component, prev, cur *types.Container) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), prev.ImageID)
+
+  ref := prevImageRef(comp)
+  kept, _, err := self.cli.ImageInspectWithRaw(self.ctx, ref)
+  if err != nil {
+    kept.ID = ""
+  }
+
+  if err := self.cli.ImageTag(self.ctx, prev.ImageID, ref); err != nil {
+    return err
+  }
+
+  // untag only, image stays under PREV_TAG
+  if prev.Image != cur.Image && prev.Image != prev.ImageID && prev.Image != ref {
+    if _, err := self.cli.ImageRemove(self.ctx, prev.Image, types.ImageRemoveOptions{}); err != nil {
+      glog.Errorf("failed to untag %s: %v", prev.Image, err)
+    }
+  }
+
+  if kept.ID != "" && kept.ID != prev.ImageID && kept.ID != cur.ImageID {
+    return self.CleanupImage(&types.Container{Image: kept.ID})
+  }
+  return nil
+}
+
+// Previous image kept for component if it's the given image, empty if not
+func (self *DockerAdapter) PrevImage(comp *manifest.Component, image_id string) string {
+  ref := prevImageRef(comp)
+  info, _, err := self.cli.ImageInspectWithRaw(self.ctx, ref)
+  if err != nil || info.ID != image_id {
+    return ""
+  }
+  return ref
+}
+
+// Set up component with local image as is, no pull
+func (self *DockerAdapter) StageLocal(comp *manifest.Component) error {
+  ref := comp.ImageRef()
+  if _, _, err := self.cli.ImageInspectWithRaw(self.ctx, ref); err != nil {
+    return err
+  }
+
+  self.staged_mutex.Lock()
+  self.staged[ref] = true
+  self.staged_mutex.Unlock()
+  return nil
+}
+
 func (self *DockerAdapter) CleanupImage(cont *types.Container) error {
   glog.Infof("%s (%v)", common.CurrentScope(), cont)
 
@@ -296,7 +424,10 @@ func (self *DockerAdapter) CleanupImage(cont *types.Container) error {
 func (self *DockerAdapter) StartContainer(comp *manifest.Component) error {
   glog.Infof("%s", common.CurrentScope())
 
-  body, err := self.cli.ContainerCreate(self.ctx, &comp.ContainerConfig, &comp.HostConfig, &comp.NetConfig, comp.ContainerName)
+  cfg := comp.ContainerConfig
+  cfg.Image = comp.ImageRef()
+
+  body, err := self.cli.ContainerCreate(self.ctx, &cfg, &comp.HostConfig, &comp.NetConfig, comp.ContainerName)
   if err != nil { return err }
 
   if err := self.cli.ContainerStart(self.ctx, body.ID, types.ContainerStartOptions{}); err != nil {
@@ -306,6 +437,8 @@ func (self *DockerAdapter) StartContainer(comp *manifest.Component) error {
   return nil
 }
 
+// Rename running container with backup name and stop it, previous backup
+// container is replaced if any
 func (self *DockerAdapter) BackupContainer(comp *manifest.Component) (*types.Container, error) {
   glog.Infof("%s", common.CurrentScope())
 
@@ -318,13 +451,28 @@ func (self *DockerAdapter) BackupContainer(comp *manifest.Component) (*types.Con
     return nil, nil
   }
 
-  backup_name := containerBackupName(cont.Names[0])
+  backup_name := containerBackupName(comp.ContainerName)
+  stale, err := self.GetContainersByName(backup_name)
+  if err != nil {
+    return nil, err
+  }
+
+  if err := self.CleanupContainer(stale); err != nil {
+    glog.Errorf("failed to cleanup stale backup container: %v", err)
+    return nil, err
+  }
+
   err = self.cli.ContainerRename(self.ctx, cont.ID, backup_name)
   if err != nil {
-    glog.Errorf("failed to rename container: ", err)
+    glog.Errorf("failed to rename container: %v", err)
     return nil, err
   }
 
+  timeout, _ := time.ParseDuration(StopTimeout)
+  if err := self.cli.ContainerStop(self.ctx, cont.ID, &timeout); err != nil {
+    glog.Errorf("failed to stop container: %v", err)
+  }
+
   cont, err = self.GetContainersByName(backup_name)
   if err != nil {
     return nil, err
@@ -332,3 +480,126 @@ func (self *DockerAdapter) BackupContainer(comp *manifest.Component) (*types.Con
 
   return cont, nil
 }
+
+// Remove the container created for component and bring backup container back
+func (self *DockerAdapter) RestoreContainer(comp *manifest.Component, prev *types.Container) error {
+  glog.Infof("%s (%v)", common.CurrentScope(), prev)
+
+  cur, err := self.GetContainersByName(comp.ContainerName)
+  if err != nil {
+    return err
+  }
+
+  if cur != nil && (prev == nil || cur.ID != prev.ID) {
+    if err := self.CleanupContainer(cur); err != nil {
+      return err
+    }
+  }
+
+  if prev == nil {
+    return nil
+  }
+
+  if err := self.cli.ContainerRename(self.ctx, prev.ID, comp.ContainerName); err != nil {
+    return err
+  }
+
+  return self.cli.ContainerStart(self.ctx, prev.ID, types.ContainerStartOptions{})
+}
+
+// Wait for container of given component to stay running for StartupGrace
+func (self *DockerAdapter) WaitStarted(comp *manifest.Component) error {
+  glog.Infof("%s", common.CurrentScope())
+
+  grace, err := time.ParseDuration(StartupGrace)
+  if err != nil {
+    return err
+  }
+
+  deadline := time.Now().Add(grace)
+  for {
+    cont, err := self.GetContainersByName(comp.ContainerName)
+    if err != nil {
+      return err
+    }
+
+    if cont == nil {
+      return fmt.Errorf("%s: container disappeared", comp.ContainerName)
+    }
+
+    info, err := self.cli.ContainerInspect(self.ctx, cont.ID)
+    if err != nil {
+      return err
+    }
+
+    if !info.State.Running || info.State.Restarting {
+      return fmt.Errorf("%s: container not running (status=%s, exit_code=%d): %s",
+        comp.ContainerName, info.State.Status, info.State.ExitCode, info.State.Error)
+    }
+
+    if time.Now().After(deadline) {
+      return nil
+    }
+    time.Sleep(time.Second)
+  }
+}
+
+// Restart container by name
+func (self *DockerAdapter) RestartContainer(name string) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), name)
+
+  cont, err := self.GetContainersByName(name)
+  if err != nil { return err }
+
+  if cont == nil {
+    return fmt.Errorf("%s: no such container", name)
+  }
+
+  timeout, _ := time.ParseDuration(StopTimeout)
+  return self.cli.ContainerRestart(self.ctx, cont.ID, &timeout)
+}
+
+// Last lines of container output, stdout and stderr interleaved, output of
+// container with tty is not multiplexed
+func (self *DockerAdapter) ContainerLogs(name, tail string) (string, error) {
+  glog.Infof("%s (%s)", common.CurrentScope(), name)
+
+  cont, err := self.GetContainersByName(name)
+  if err != nil { return "", err }
+
+  if cont == nil {
+    return "", fmt.Errorf("%s: no such container", name)
+  }
+
+  info, err := self.cli.ContainerInspect(self.ctx, cont.ID)
+  if err != nil { return "", err }
+
+  rd, err := self.cli.ContainerLogs(self.ctx, cont.ID, types.ContainerLogsOptions{
+    ShowStdout: true,
+    ShowStderr: true,
+    Timestamps: true,
+    Tail: tail,
+  })
+  if err != nil { return "", err }
+  defer rd.Close()
+
+  var out bytes.Buffer
+  if info.Config != nil && info.Config.Tty {
+    _, err = io.Copy(&out, rd)
+  } else {
+    _, err = stdcopy.StdCopy(&out, &out, rd)
+  }
+  if err != nil { return "", err }
+  return out.String(), nil
+}
+
+// Remove dangling images
+func (self *DockerAdapter) PruneImages() (*types.ImagesPruneReport, error) {
+  glog.Infof("%s", common.CurrentScope())
+
+  args := filters.NewArgs()
+  args.Add("dangling", "true")
+  report, err := self.cli.ImagesPrune(self.ctx, args)
+  if err != nil { return nil, err }
+  return &report, nil
+}
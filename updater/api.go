@@ -0,0 +1,324 @@
+package updater
+
+import (
+  "os"
+  "net"
+  "time"
+  "strings"
+  "strconv"
+  "net/http"
+  "io/ioutil"
+  "encoding/json"
+  "crypto/subtle"
+  "github.com/golang/glog"
+  "github.com/docker/docker/api/types"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/state"
+)
+
+var (
+  // address of local control api, host:port or unix:<socket path>
+  API_ADDR = common.GetEnvOr("API_ADDR", "unix:/run/updated.sock")
+  // bearer token required by api, mandatory when not on unix socket
+  API_TOKEN = common.GetEnvOr("API_TOKEN", "")
+)
+
+const (
+  API_STATUS = "/status"
+  API_HISTORY = "/history"
+  API_MANIFEST = "/manifest"
+  API_PLAN = "/plan"
+  API_RUN = "/run"
+  API_ACTIVATE = "/activate"
+  API_ACTION = "/action"
+  // max size of posted manifest
+  API_BODY_MAX = 4 * 1024 * 1024
+)
+
+type ApiStatus struct {
+  Version string `json:"version,omitempty"`
+  LastRun time.Time `json:"last_run,omitempty"`
+  LastError string `json:"last_error,omitempty"`
+  Containers []types.Container `json:"containers,omitempty"`
+  LastApplied *state.Record `json:"last_applied,omitempty"`
+  // staged manifest waiting for activation
+  Pending string `json:"pending,omitempty"`
+  PendingActivateAt time.Time `json:"pending_activate_at,omitempty"`
+  // manifest waiting for maintenance window
+  Queued string `json:"queued,omitempty"`
+}
+
+type ApiResult struct {
+  Result string `json:"result,omitempty"`
+  Error string `json:"error,omitempty"`
+  Record *state.CompRecord `json:"record,omitempty"`
+  // output of maintenance action
+  Output json.RawMessage `json:"output,omitempty"`
+}
+
+// Listen on API_ADDR, unix socket if prefixed with "unix:"
+func listenApi(addr string) (net.Listener, error) {
+  if !strings.HasPrefix(addr, "unix:") {
+    return net.Listen("tcp", addr)
+  }
+
+  path := strings.TrimPrefix(addr, "unix:")
+  os.RemoveAll(path)
+  ln, err := net.Listen("unix", path)
+  if err != nil { return nil, err }
+
+  if err := os.Chmod(path, 0660); err != nil {
+    ln.Close()
+    return nil, err
+  }
+  return ln, nil
+}
+
+func (self *Daemon) startApi() {
+  glog.Infof("%s (%s)", common.CurrentScope(), API_ADDR)
+
+  if !strings.HasPrefix(API_ADDR, "unix:") && API_TOKEN == "" {
+    glog.Errorf("api on %s requires API_TOKEN, not started", API_ADDR)
+    return
+  }
+
+  ln, err := listenApi(API_ADDR)
+  if err != nil {
+    glog.Errorf("failed to listen api: %v", err)
+    return
+  }
+
+  if err := self.api.Serve(ln); err != nil && err != http.ErrServerClosed {
+    glog.Errorf("api stopped: %v", err)
+  }
+}
+
+func (self *Daemon) apiHandler() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc(API_STATUS, self.handleStatus)
+  mux.HandleFunc(API_HISTORY, self.handleHistory)
+  mux.HandleFunc(API_MANIFEST, self.handleManifest)
+  mux.HandleFunc(API_PLAN, self.handlePlan)
+  mux.HandleFunc(API_RUN, self.handleRun)
+  mux.HandleFunc(API_ACTIVATE, self.handleActivate)
+  mux.HandleFunc(API_ACTION, self.handleAction)
+  return requireToken(API_TOKEN, mux)
+}
+
+// Reject requests without bearer token if token is set
+func requireToken(token string, next http.Handler) http.Handler {
+  if token == "" { return next }
+
+  want := []byte("Bearer " + token)
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    got := []byte(r.Header.Get("Authorization"))
+    if subtle.ConstantTimeCompare(got, want) != 1 {
+      writeJson(w, http.StatusUnauthorized, &ApiResult{Error: "unauthorized"})
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+  data, err := json.Marshal(v)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  w.Write(data)
+}
+
+func writeResult(w http.ResponseWriter, status int, err error) {
+  if err != nil {
+    writeJson(w, status, &ApiResult{Error: err.Error()})
+    return
+  }
+  writeJson(w, status, &ApiResult{Result: "ok"})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+  if r.Method == method { return true }
+  w.Header().Set("Allow", method)
+  writeJson(w, http.StatusMethodNotAllowed, &ApiResult{Error: "method not allowed"})
+  return false
+}
+
+// GET current containers, last run and last applied manifest
+func (self *Daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s", common.CurrentScope())
+  if !allowMethod(w, r, http.MethodGet) { return }
+
+  writeJson(w, http.StatusOK, self.Status())
+}
+
+// Current containers, last run and last applied manifest
+func (self *Daemon) Status() *ApiStatus {
+  self.status_mutex.Lock()
+  status := &ApiStatus{
+    Version: common.VERSION,
+    LastRun: self.last_run,
+    LastError: self.last_err,
+  }
+  self.status_mutex.Unlock()
+
+  if pending := self.Pending(); pending != nil {
+    status.Pending = pending.Id()
+    status.PendingActivateAt = pending.ActivateAt
+  }
+
+  if queued := self.Queued(); queued != nil {
+    status.Queued = queued.Id()
+  }
+
+  if hist := self.store.History(1); len(hist) > 0 {
+    status.LastApplied = &hist[0]
+  }
+
+  containers, err := self.adapt.ListContainers()
+  if err != nil {
+    glog.Errorf("failed to list containers: %v", err)
+  }
+  status.Containers = containers
+  return status
+}
+
+// GET applied manifests from the newest, limited by query "limit"
+func (self *Daemon) handleHistory(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s", common.CurrentScope())
+  if !allowMethod(w, r, http.MethodGet) { return }
+
+  limit := 0
+  if l := r.URL.Query().Get("limit"); l != "" {
+    var err error
+    if limit, err = strconv.Atoi(l); err != nil {
+      writeResult(w, http.StatusBadRequest, err)
+      return
+    }
+  }
+
+  writeJson(w, http.StatusOK, self.store.History(limit))
+}
+
+// POST signed update manifest in json or encoded, applied before responding
+func (self *Daemon) handleManifest(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s", common.CurrentScope())
+  if !allowMethod(w, r, http.MethodPost) { return }
+
+  data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_BODY_MAX))
+  if err != nil {
+    writeResult(w, http.StatusBadRequest, err)
+    return
+  }
+
+  mani, err := self.openData(data)
+  if err != nil {
+    self.pubApplyError(err)
+    writeResult(w, http.StatusBadRequest, err)
+    return
+  }
+
+  err = self.apply(mani)
+  self.setLastRun(err)
+  if err != nil {
+    self.pubApplyError(err)
+    writeResult(w, http.StatusUnprocessableEntity, err)
+    return
+  }
+  writeResult(w, http.StatusOK, nil)
+}
+
+// POST signed update manifest in json or encoded, plan is returned and published
+func (self *Daemon) handlePlan(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s", common.CurrentScope())
+  if !allowMethod(w, r, http.MethodPost) { return }
+
+  data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_BODY_MAX))
+  if err != nil {
+    writeResult(w, http.StatusBadRequest, err)
+    return
+  }
+
+  mani, err := self.openData(data)
+  if err != nil {
+    writeResult(w, http.StatusBadRequest, err)
+    return
+  }
+
+  plan, err := self.Plan(mani)
+  if err != nil {
+    writeResult(w, http.StatusUnprocessableEntity, err)
+    return
+  }
+
+  if err := self.pubPlan(plan); err != nil {
+    glog.Errorf("failed to publish plan: %v", err)
+  }
+  writeJson(w, http.StatusOK, plan)
+}
+
+// POST trigger a pull mode run in background
+func (self *Daemon) handleRun(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s", common.CurrentScope())
+  if !allowMethod(w, r, http.MethodPost) { return }
+
+  go self.RunOnce()
+  writeJson(w, http.StatusAccepted, &ApiResult{Result: "accepted"})
+}
+
+// POST activate staged manifest, id of manifest in body is optional
+func (self *Daemon) handleActivate(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s", common.CurrentScope())
+  if !allowMethod(w, r, http.MethodPost) { return }
+
+  data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_BODY_MAX))
+  if err != nil {
+    writeResult(w, http.StatusBadRequest, err)
+    return
+  }
+
+  if err := self.Activate(strings.TrimSpace(string(data))); err != nil {
+    writeResult(w, http.StatusUnprocessableEntity, err)
+    return
+  }
+  writeResult(w, http.StatusOK, nil)
+}
+
+// POST action request sealed in envelope, action is run before responding,
+// rollback is one of them
+func (self *Daemon) handleAction(w http.ResponseWriter, r *http.Request) {
+  glog.Infof("%s", common.CurrentScope())
+  if !allowMethod(w, r, http.MethodPost) { return }
+
+  data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_BODY_MAX))
+  if err != nil {
+    writeResult(w, http.StatusBadRequest, err)
+    return
+  }
+
+  env, err := manifest.ParseEnvelope(data)
+  if err != nil {
+    writeResult(w, http.StatusBadRequest, err)
+    return
+  }
+
+  out, err := self.RunAction(env, "", ACTION_VIA_API)
+  if err != nil {
+    writeResult(w, http.StatusUnprocessableEntity, err)
+    return
+  }
+
+  ret := &ApiResult{Result: "ok"}
+  if out != nil {
+    if ret.Output, err = json.Marshal(out); err != nil {
+      writeResult(w, http.StatusInternalServerError, err)
+      return
+    }
+  }
+  writeJson(w, http.StatusOK, ret)
+}
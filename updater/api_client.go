@@ -0,0 +1,123 @@
+package updater
+
+import (
+  "fmt"
+  "net"
+  "bytes"
+  "context"
+  "strings"
+  "net/http"
+  "io/ioutil"
+  "encoding/json"
+
+  "github.com/zex/container-update/state"
+  "github.com/zex/container-update/manifest"
+)
+
+// Client of local control api
+type ApiClient struct {
+  base string
+  cli *http.Client
+  // bearer token sent with requests
+  Token string
+}
+
+func NewApiClient(addr string) *ApiClient {
+  if !strings.HasPrefix(addr, "unix:") {
+    return &ApiClient{
+      base: fmt.Sprintf("http://%s", addr),
+      cli: &http.Client{},
+    }
+  }
+
+  path := strings.TrimPrefix(addr, "unix:")
+  return &ApiClient{
+    base: "http://updated",
+    cli: &http.Client{
+      Transport: &http.Transport{
+        DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+          var d net.Dialer
+          return d.DialContext(ctx, "unix", path)
+        },
+      },
+    },
+  }
+}
+
+func (self *ApiClient) do(method, path string, body []byte, ret interface{}) error {
+  req, err := http.NewRequest(method, self.base + path, bytes.NewReader(body))
+  if err != nil { return err }
+  if self.Token != "" {
+    req.Header.Set("Authorization", "Bearer " + self.Token)
+  }
+
+  rsp, err := self.cli.Do(req)
+  if err != nil { return err }
+  defer rsp.Body.Close()
+
+  data, err := ioutil.ReadAll(rsp.Body)
+  if err != nil { return err }
+
+  if rsp.StatusCode >= http.StatusBadRequest {
+    var res ApiResult
+    if err := json.Unmarshal(data, &res); err == nil && res.Error != "" {
+      return fmt.Errorf("%s", res.Error)
+    }
+    return fmt.Errorf("unexpected status %s", rsp.Status)
+  }
+
+  if ret == nil { return nil }
+  return json.Unmarshal(data, ret)
+}
+
+func (self *ApiClient) Status() (*ApiStatus, error) {
+  var ret ApiStatus
+  if err := self.do(http.MethodGet, API_STATUS, nil, &ret); err != nil {
+    return nil, err
+  }
+  return &ret, nil
+}
+
+func (self *ApiClient) History(limit int) ([]state.Record, error) {
+  var ret []state.Record
+  path := fmt.Sprintf("%s?limit=%d", API_HISTORY, limit)
+  if err := self.do(http.MethodGet, path, nil, &ret); err != nil {
+    return nil, err
+  }
+  return ret, nil
+}
+
+// Apply signed update manifest in json or encoded
+func (self *ApiClient) Apply(data []byte) error {
+  return self.do(http.MethodPost, API_MANIFEST, data, nil)
+}
+
+// Plan signed update manifest in json or encoded
+func (self *ApiClient) Plan(data []byte) (*Plan, error) {
+  var ret Plan
+  if err := self.do(http.MethodPost, API_PLAN, data, &ret); err != nil {
+    return nil, err
+  }
+  return &ret, nil
+}
+
+func (self *ApiClient) Run() error {
+  return self.do(http.MethodPost, API_RUN, nil, nil)
+}
+
+// Activate staged manifest, any staged manifest if id is empty
+func (self *ApiClient) Activate(id string) error {
+  return self.do(http.MethodPost, API_ACTIVATE, []byte(id), nil)
+}
+
+// Run maintenance action sealed in envelope
+func (self *ApiClient) Action(env *manifest.Envelope) (*ApiResult, error) {
+  data, err := json.Marshal(env)
+  if err != nil { return nil, err }
+
+  var ret ApiResult
+  if err := self.do(http.MethodPost, API_ACTION, data, &ret); err != nil {
+    return nil, err
+  }
+  return &ret, nil
+}
@@ -0,0 +1,231 @@
+package updater
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "encoding/json"
+  "github.com/golang/glog"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+)
+
+const (
+  // max lines of logs collected if not given
+  LOGS_TAIL_DEFAULT = 200
+  // max size of logs in result
+  LOGS_MAX = 256 * 1024
+  // how long ids of handled commands are remembered to drop redeliveries
+  COMMAND_SEEN_TTL = time.Hour
+)
+
+// Arguments of commands targeting one component
+type CompArgs struct {
+  Component string `json:"component"`
+  // lines of logs to collect
+  Tail int `json:"tail,omitempty"`
+}
+
+// Result of collect-logs
+type LogsResult struct {
+  Component string `json:"component"`
+  ContainerName string `json:"container_name"`
+  Logs string `json:"logs"`
+  Truncated bool `json:"truncated,omitempty"`
+}
+
+// Command handler, started is called once work on the command begins
+type commandFn func(self *Daemon, args json.RawMessage, started func()) (interface{}, error)
+
+var commands = map[common.CommandType]commandFn {
+  common.CommandApply: (*Daemon).cmdApply,
+  common.CommandStatus: (*Daemon).cmdStatus,
+  common.CommandRollback: (*Daemon).cmdRollback,
+  common.CommandPrune: (*Daemon).cmdPrune,
+  common.CommandRestartComponent: (*Daemon).cmdRestartComponent,
+  common.CommandCollectLogs: (*Daemon).cmdCollectLogs,
+  common.CommandAction: (*Daemon).cmdAction,
+}
+
+// Run command from message bus, progress and result are replied on reply
+// topic, command refused or interrupted for shutdown is reported back to be
+// delivered again, redelivery of a handled command is dropped
+func (self *Daemon) handleCommand(data []byte) error {
+  glog.Infof("%s", common.CurrentScope())
+
+  var cmd common.Command
+  if err := json.Unmarshal(data, &cmd); err != nil {
+    glog.Error("failed to parse command: ", err)
+    return nil
+  }
+
+  fn, ok := commands[cmd.Ty]
+  switch {
+  case cmd.Id == "":
+    glog.Errorf("command without id dropped: %s", cmd.Ty)
+    return nil
+  case !ok:
+    self.reply(&cmd, common.ReplyResult, nil, fmt.Errorf("unknown command type: %s", cmd.Ty))
+    return nil
+  case self.ctx.Err() != nil:
+    return ErrStopping
+  case !self.markCommand(cmd.Id):
+    glog.Infof("command %s already handled, dropped", cmd.Id)
+    return nil
+  }
+
+  self.reply(&cmd, common.ReplyAccepted, nil, nil)
+  var once sync.Once
+  started := func() {
+    once.Do(func() { self.reply(&cmd, common.ReplyInProgress, nil, nil) })
+  }
+
+  ret, err := fn(self, cmd.Args, started)
+  if err == ErrStopping || (err != nil && self.ctx.Err() != nil) {
+    self.forgetCommand(cmd.Id)
+    return ErrStopping
+  }
+  // in-progress precedes result also for commands refused or done at once
+  started()
+  self.reply(&cmd, common.ReplyResult, ret, err)
+  return nil
+}
+
+// Remember command id, false if seen within COMMAND_SEEN_TTL
+func (self *Daemon) markCommand(id string) bool {
+  self.seen_mutex.Lock()
+  defer self.seen_mutex.Unlock()
+
+  now := time.Now()
+  for k, at := range self.cmd_seen {
+    if now.Sub(at) > COMMAND_SEEN_TTL { delete(self.cmd_seen, k) }
+  }
+
+  if _, ok := self.cmd_seen[id]; ok {
+    return false
+  }
+  self.cmd_seen[id] = now
+  return true
+}
+
+func (self *Daemon) forgetCommand(id string) {
+  self.seen_mutex.Lock()
+  delete(self.cmd_seen, id)
+  self.seen_mutex.Unlock()
+}
+
+func (self *Daemon) reply(cmd *common.Command, state common.ReplyState, ret interface{}, err error) {
+  glog.Infof("%s (%s, %s)", common.CurrentScope(), cmd.Id, state)
+
+  rep := common.NewReply(cmd, state)
+  if err != nil {
+    rep.Error = err.Error()
+  }
+
+  if ret != nil {
+    data, e := json.Marshal(ret)
+    if e != nil {
+      rep.Error = fmt.Sprintf("failed to encode result: %v", e)
+    }
+    rep.Result = data
+  }
+
+  data, e := json.Marshal(rep)
+  if e != nil {
+    glog.Errorf("failed to encode reply: %v", e)
+    return
+  }
+
+  if e := self.sub.Publish(common.TopicReply, data); e != nil {
+    glog.Errorf("failed to reply %s: %v", cmd.Id, e)
+  }
+}
+
+// Signed manifest given as json object, or as encoded string
+func (self *Daemon) cmdApply(args json.RawMessage, started func()) (interface{}, error) {
+  data := []byte(args)
+  var encoded string
+  if err := json.Unmarshal(args, &encoded); err == nil {
+    data = []byte(encoded)
+  }
+
+  mani, err := self.openData(data)
+  if err == nil {
+    started()
+    err = self.apply(mani)
+  }
+  if err == ErrStopping {
+    return nil, err
+  }
+
+  self.setLastRun(err)
+  if err != nil {
+    self.pubApplyError(err)
+    return nil, err
+  }
+
+  if hist := self.store.History(1); len(hist) > 0 &&
+      hist[0].ManifestCreatedAt.Equal(mani.CreatedAt) {
+    return &hist[0], nil
+  }
+  // staged or queued
+  return nil, nil
+}
+
+func (self *Daemon) cmdStatus(args json.RawMessage, started func()) (interface{}, error) {
+  return self.Status(), nil
+}
+
+func parseCompArgs(args json.RawMessage) (*CompArgs, error) {
+  var ret CompArgs
+  if err := json.Unmarshal(args, &ret); err != nil {
+    return nil, fmt.Errorf("invalid arguments: %v", err)
+  }
+
+  if ret.Component == "" {
+    return nil, fmt.Errorf("component not given")
+  }
+  return &ret, nil
+}
+
+// Container name of component as last set up, the name itself if never
+func (self *Daemon) containerOf(name string) string {
+  if rec := self.store.LastComponent(name); rec != nil && rec.ContainerName != "" {
+    return rec.ContainerName
+  }
+  return name
+}
+
+func (self *Daemon) cmdRollback(args json.RawMessage, started func()) (interface{}, error) {
+  return self.runActionArgs(args, ACTION_ROLLBACK, started)
+}
+
+// Args is an action request sealed in envelope, of the given action if not
+// empty
+func (self *Daemon) runActionArgs(args json.RawMessage, action string,
+  started func()) (interface{}, error) {
+  var env manifest.Envelope
+  if err := json.Unmarshal(args, &env); err != nil {
+    return nil, fmt.Errorf("invalid action request: %v", err)
+  }
+
+  started()
+  return self.RunAction(&env, action, ACTION_VIA_BUS)
+}
+
+func (self *Daemon) cmdAction(args json.RawMessage, started func()) (interface{}, error) {
+  return self.runActionArgs(args, "", started)
+}
+
+func (self *Daemon) cmdPrune(args json.RawMessage, started func()) (interface{}, error) {
+  return self.runActionArgs(args, ACTION_PRUNE_IMAGES, started)
+}
+
+func (self *Daemon) cmdRestartComponent(args json.RawMessage, started func()) (interface{}, error) {
+  return self.runActionArgs(args, ACTION_RESTART_COMPONENT, started)
+}
+
+func (self *Daemon) cmdCollectLogs(args json.RawMessage, started func()) (interface{}, error) {
+  return self.runActionArgs(args, ACTION_COLLECT_LOGS, started)
+}
@@ -2,15 +2,23 @@ package updater
 
 import (
   "fmt"
+  "context"
+  "errors"
   "os"
+  "os/signal"
+  "syscall"
+  "time"
+  "strings"
+  "crypto"
+  "net/http"
   "encoding/json"
   "sync"
   "github.com/golang/glog"
   "github.com/zex/container-update/manifest"
   "github.com/zex/container-update/common"
-  mq "github.com/zex/container-update/mqtt"
-  "github.com/eclipse/paho.mqtt.golang"
+  "github.com/zex/container-update/transport"
   sched "github.com/zex/container-update/sched"
+  "github.com/zex/container-update/state"
 )
 
 const (
@@ -19,23 +27,314 @@ const (
   WORK_MODE_DUAL = "dual"
 )
 
+var (
+  // PEM public key file or directory of them, manifest must be signed by one of the keys
+  TRUSTED_KEYS = os.Getenv("TRUSTED_KEYS")
+  // manifest refused or work abandoned while shutting down
+  ErrStopping = errors.New("updater stopping")
+)
+
+// Manifest refused for being older than the last applied one, or of the same
+// time but another digest
+type ReplayError struct {
+  CreatedAt time.Time
+  LastApplied time.Time
+}
+
+func (e *ReplayError) Error() string {
+  return fmt.Sprintf("manifest created at %v is not newer than last applied %v",
+    e.CreatedAt, e.LastApplied)
+}
+
 type Daemon struct {
   sched_mutex *sync.Mutex
-  sub *mq.Sub
+  apply_mutex *sync.Mutex
+  sub common.Transport
   sched *sched.Sched
   up IUpdater
+  trusted []crypto.PublicKey
+  store *state.Store
+  adapt IDocker
+  // result of the last run
+  status_mutex *sync.Mutex
+  last_run time.Time
+  last_err string
+  // staged manifest waiting for activation
+  pending_mutex *sync.Mutex
+  pending *manifest.UpdateManifest
+  pending_timer *time.Timer
+  // manifest waiting for maintenance window
+  queue_mutex *sync.Mutex
+  queued *manifest.UpdateManifest
+  queue_timer *time.Timer
+  // canceled on shutdown
+  ctx context.Context
+  stop context.CancelFunc
+  api *http.Server
+  // keys authorized by maintenance action
+  action_keys map[string][]crypto.PublicKey
+  // ids of recent action requests and commands
+  seen_mutex *sync.Mutex
+  seen map[string]time.Time
+  cmd_seen map[string]time.Time
 }
 
 func NewDaemon() *Daemon {
   ret := &Daemon {
     sched_mutex: &sync.Mutex{},
+    apply_mutex: &sync.Mutex{},
+    status_mutex: &sync.Mutex{},
+    pending_mutex: &sync.Mutex{},
+    queue_mutex: &sync.Mutex{},
+    seen_mutex: &sync.Mutex{},
+    seen: make(map[string]time.Time),
+    cmd_seen: make(map[string]time.Time),
+  }
+  ret.ctx, ret.stop = context.WithCancel(context.Background())
+  store, err := state.NewStore(state.STATE_ROOT)
+  if err != nil {
+    glog.Fatal(err)
+  }
+  ret.store = store
+  if ret.sub, err = transport.LoadTransport(ret); err != nil {
+    panic(fmt.Sprintf("load subscribe manifest failed: %v", err))
   }
-  ret.sub = mq.NewSub(ret)
-  ret.up = NewDockerUpdater(ret.sub)
+  ret.adapt = NewDockerAdapter(ret.ctx, ret.sub)
+  ret.up = NewDockerUpdater(ret.ctx, ret.stop, ret.sub, ret.store)
+  ret.loadTrustedKeys()
+  ret.loadActionKeys()
   return ret
 }
 
-// Fetch manifest
+func (self *Daemon) loadTrustedKeys() {
+  glog.Infof("%s", common.CurrentScope())
+
+  if TRUSTED_KEYS == "" {
+    glog.Error("TRUSTED_KEYS not defined, all manifests will be rejected")
+    return
+  }
+
+  keys, err := manifest.LoadPublicKeys(TRUSTED_KEYS)
+  if err != nil {
+    glog.Errorf("failed to load trusted keys: %v", err)
+    return
+  }
+  self.trusted = keys
+}
+
+// Verify signed manifest and parse it
+func (self *Daemon) open(env *manifest.Envelope) (*manifest.UpdateManifest, error) {
+  mani, err := env.UpdateManifest(self.trusted)
+  if err != nil {
+    return nil, fmt.Errorf("manifest rejected: %v", err)
+  }
+  return mani, nil
+}
+
+// Verify signed manifest in json or encoded and parse it
+func (self *Daemon) openData(data []byte) (*manifest.UpdateManifest, error) {
+  env, err := manifest.ParseEnvelope(data)
+  if err != nil {
+    return nil, fmt.Errorf("invalid manifest: %v", err)
+  }
+  return self.open(env)
+}
+
+// Manifest must come from verified envelope
+func verified(mani *manifest.UpdateManifest) error {
+  if mani.Envelope == nil {
+    return fmt.Errorf("manifest rejected: not verified")
+  }
+  return nil
+}
+
+// Plan components of verified manifest without applying
+func (self *Daemon) Plan(mani *manifest.UpdateManifest) (*Plan, error) {
+  glog.Infof("%s", common.CurrentScope())
+
+  if err := verified(mani); err != nil {
+    return nil, err
+  }
+
+  plan := self.up.PlanComponents(mani)
+  if _, err := applyTarget(mani, self.store.LastAppliedRecord()); err != nil {
+    plan.Rejected = err.Error()
+  }
+  return plan, nil
+}
+
+// Set up components of verified manifest, manifest with PlanOnly set is
+// planned and published instead
+func (self *Daemon) apply(mani *manifest.UpdateManifest) error {
+  glog.Infof("%s", common.CurrentScope())
+
+  if self.ctx.Err() != nil {
+    return ErrStopping
+  }
+
+  if mani.PlanOnly {
+    plan, err := self.Plan(mani)
+    if err != nil { return err }
+    return self.pubPlan(plan)
+  }
+
+  if err := verified(mani); err != nil {
+    return err
+  }
+
+  last := self.store.LastAppliedRecord()
+  target, err := applyTarget(mani, last)
+  if err != nil { return err }
+
+  // manifest applied already, e.g. fetched again on each run in pull mode,
+  // only drifted components are set up again
+  if sameApplied(mani, last) {
+    if !self.up.PlanComponents(target).NeedUpdate() {
+      glog.Infof("%s already applied, no drift", mani.Id())
+      return nil
+    }
+  } else if target.TwoPhase() {
+    // images are pulled without apply_mutex held, pull window might be hours away
+    return self.stage(target)
+  }
+  if err := self.up.StageComponents(target); err != nil {
+    glog.Errorf("%v, pulled again on setup", err)
+  }
+
+  self.apply_mutex.Lock()
+  defer self.apply_mutex.Unlock()
+
+  if self.ctx.Err() != nil {
+    return ErrStopping
+  }
+
+  // a newer manifest might have been applied while pulling
+  if target, err = applyTarget(mani, self.store.LastAppliedRecord()); err != nil {
+    return err
+  }
+  return self.setupInWindow(target)
+}
+
+// Manifest is the last applied one, legacy record has no digest
+func sameApplied(mani *manifest.UpdateManifest, last *state.Record) bool {
+  return last != nil && mani.CreatedAt.Equal(last.ManifestCreatedAt) &&
+    (last.ManifestDigest == "" || last.ManifestDigest == mani.Digest)
+}
+
+// Components of manifest to set up given the last applied manifest, older
+// manifest is refused, the last applied one is set up again without forcing
+func applyTarget(mani *manifest.UpdateManifest, last *state.Record) (*manifest.UpdateManifest, error) {
+  if last == nil || mani.CreatedAt.After(last.ManifestCreatedAt) {
+    return mani, nil
+  }
+
+  if sameApplied(mani, last) {
+    ret := *mani
+    ret.Components = nil
+    for _, comp := range mani.Components {
+      comp.Force = false
+      ret.Components = append(ret.Components, comp)
+    }
+    return &ret, nil
+  }
+
+  target := filterDowngrade(mani)
+  if len(target.Components) == 0 {
+    return nil, &ReplayError{CreatedAt: mani.CreatedAt, LastApplied: last.ManifestCreatedAt}
+  }
+  glog.Infof("downgrade allowed for %d component(s)", len(target.Components))
+  return target, nil
+}
+
+// Set up the previous image of component recorded in state store, called
+// with apply_mutex held
+func (self *Daemon) rollback(name string) (*state.CompRecord, error) {
+  glog.Infof("%s (%s)", common.CurrentScope(), name)
+
+  if name == manifest.COMP_UPDATER {
+    return nil, fmt.Errorf("rollback of %s not supported", name)
+  }
+
+  rec := self.store.LastComponent(name)
+  if rec == nil || rec.Spec == nil {
+    return nil, fmt.Errorf("%s: no history", name)
+  }
+
+  if rec.PrevDigest == "" || rec.PrevDigest == rec.Digest {
+    return nil, fmt.Errorf("%s: no previous image", name)
+  }
+
+  comp := *rec.Spec
+  comp.ImageDigest = ""
+  comp.DependsOn = nil
+  comp.Force = true
+
+  // image kept since the update, pulled again by reference otherwise
+  if kept := self.adapt.PrevImage(&comp, rec.PrevDigest); kept != "" {
+    comp.ContainerConfig.Image = kept
+    if err := self.adapt.StageLocal(&comp); err != nil {
+      return nil, fmt.Errorf("%s: previous image not available: %v", name, err)
+    }
+  } else if rec.PrevImage != "" && !strings.HasPrefix(rec.PrevImage, "sha256:") {
+    comp.ContainerConfig.Image = rec.PrevImage
+  } else {
+    return nil, fmt.Errorf("%s: previous image %s not kept", name, rec.PrevDigest)
+  }
+
+  if self.ctx.Err() != nil {
+    return nil, ErrStopping
+  }
+  // outcome is taken from the record
+  self.up.SetupComponents(&manifest.UpdateManifest{
+    Components: []manifest.Component{comp},
+  })
+
+  rec = self.store.LastComponent(name)
+  if rec != nil && rec.Outcome == state.OutcomeFailed {
+    return rec, fmt.Errorf("%s: rollback failed: %s", name, rec.Error)
+  }
+  return rec, nil
+}
+
+func (self *Daemon) setLastRun(err error) {
+  self.status_mutex.Lock()
+  defer self.status_mutex.Unlock()
+
+  self.last_run = time.Now()
+  self.last_err = ""
+  if err != nil {
+    self.last_err = err.Error()
+  }
+}
+
+// Keep components which explicitly allow downgrade
+func filterDowngrade(mani *manifest.UpdateManifest) *manifest.UpdateManifest {
+  ret := *mani
+  ret.Components = nil
+  for _, comp := range mani.Components {
+    if comp.AllowDowngrade {
+      ret.Components = append(ret.Components, comp)
+    }
+  }
+  return &ret
+}
+
+// Report failure of apply through event topic
+func (self *Daemon) pubApplyError(err error) {
+  glog.Error(err)
+  if err == ErrStopping { return }
+  if _, ok := err.(*ReplayError); ok {
+    ev := common.NewEvent()
+    ev.Publisher = self.sub
+    ev.Ty = common.EventTypeRejected
+    ev.Payload = err.Error()
+    ev.Publish()
+    return
+  }
+  self.pubError(err.Error())
+}
+
+// Fetch manifest and verify it
 func (self *Daemon) fetchMani() (*manifest.UpdateManifest, error) {
   glog.Infof("%s", common.CurrentScope())
 
@@ -49,7 +348,11 @@ func (self *Daemon) fetchMani() (*manifest.UpdateManifest, error) {
     return nil, err
   }
 
-  return manifest.FetchUpdateMani(asset.Url)
+  env, err := manifest.FetchUpdateMani(asset.Url)
+  if err != nil {
+    return nil, err
+  }
+  return self.open(env)
 }
 
 // interface TimeoutHandler callback
@@ -61,46 +364,114 @@ func (self *Daemon) RunOnce() {
 
   mani, err := self.fetchMani()
   if err != nil {
-    glog.Error(err)
+    self.setLastRun(err)
+    self.pubApplyError(err)
     return
   }
 
-  self.up.SetupComponents(mani)
+  err = self.apply(mani)
+  self.setLastRun(err)
+  if err != nil {
+    self.pubApplyError(err)
+  }
 }
 
-// MQ message handler
-func (self *Daemon) Handle(msg mqtt.Message) {
-  glog.Infof("%s", common.CurrentScope())
-  data := msg.Payload()
+// MQ message handler, returns once manifest is set up, only message refused
+// for shutdown is reported back to be delivered again
+func (self *Daemon) Handle(topic string, data []byte) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), topic)
 
-  var mani manifest.UpdateManifest
-  if err := json.Unmarshal(data, &mani); err != nil {
-    glog.Error("failed to parse json: ", err)
-    return
+  if command := self.sub.Topic(common.TopicCommand); command != "" && topic == command {
+    return self.handleCommand(data)
   }
 
-  self.up.SetupComponents(&mani)
+  if activate := self.sub.Topic(common.TopicActivate); activate != "" && topic == activate {
+    err := self.Activate(strings.TrimSpace(string(data)))
+    if err == ErrStopping {
+      return err
+    }
+    if err != nil {
+      glog.Error(err)
+      self.pubError(err.Error())
+    }
+    return nil
+  }
+
+  mani, err := self.openData(data)
+  if err == nil {
+    err = self.apply(mani)
+  }
+  if err == ErrStopping {
+    return err
+  }
+  self.setLastRun(err)
+  if err == nil { return nil }
+
+  self.pubApplyError(err)
+  // worth another try, delivered again by transports which do so
+  if _, ok := err.(*SetupError); ok {
+    return err
+  }
+  return nil
 }
 
-func (self *Daemon) startSub() {
+func (self *Daemon) startSub(ctx context.Context) {
   glog.Infof("%s", common.CurrentScope())
-  self.sub.SubUpdate()
   go self.pubStarted()
-  self.sub.StartSub()
+  self.sub.StartSub(ctx)
 }
 
 func (self *Daemon) startSched() {
   glog.Infof("%s", common.CurrentScope())
-  self.RunOnce()
 
   self.sched = sched.NewSched(self)
-  self.sched.StartSched()
+  self.sched.Start(self.ctx)
+}
+
+// Stop on SIGTERM or SIGINT
+func (self *Daemon) handleSignals() {
+  c := make(chan os.Signal, 1)
+  signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+  defer signal.Stop(c)
+
+  select {
+  case sig := <-c:
+    glog.Infof("received %v", sig)
+    self.Stop()
+  case <-self.ctx.Done():
+  }
+}
+
+// Stop accepting manifests and shut down, Start returns once done
+func (self *Daemon) Stop() {
+  self.stop()
 }
 
-func (self *Daemon) startDual() {
+// Wait for manifest being applied to finish or reach a safe point, timers
+// are dropped as pending and queued manifests are reloaded on next start
+func (self *Daemon) shutdown() {
   glog.Infof("%s", common.CurrentScope())
-  go self.startSub()
-  self.startSched()
+
+  if self.api != nil {
+    self.api.Close()
+  }
+
+  self.pending_mutex.Lock()
+  if self.pending_timer != nil {
+    self.pending_timer.Stop()
+  }
+  self.pending_mutex.Unlock()
+
+  self.queue_mutex.Lock()
+  if self.queue_timer != nil {
+    self.queue_timer.Stop()
+  }
+  self.queue_mutex.Unlock()
+
+  // whoever waits for the lock next sees the context done
+  self.apply_mutex.Lock()
+  self.pubStopped()
+  self.apply_mutex.Unlock()
 }
 
 func (self *Daemon) pubStarted() {
@@ -112,17 +483,83 @@ func (self *Daemon) pubStarted() {
   ev.Publish()
 }
 
+func (self *Daemon) pubStopped() {
+  glog.Infof("%s", common.CurrentScope())
+
+  ev := common.NewEvent()
+  ev.Publisher = self.sub
+  ev.Ty = common.EventTypeStopped
+  if err := ev.Publish(); err != nil {
+    glog.Errorf("failed to publish stopped event: %v", err)
+  }
+}
+
+func (self *Daemon) pubPlan(plan *Plan) error {
+  glog.Infof("%s", common.CurrentScope())
+
+  data, err := json.Marshal(plan)
+  if err != nil { return err }
+
+  ev := common.NewEvent()
+  ev.Publisher = self.sub
+  ev.Ty = common.EventTypePlan
+  ev.Payload = string(data)
+  return ev.Publish()
+}
+
+func (self *Daemon) pubError(e string) {
+  ev := common.NewErrEvent(e)
+  ev.Publisher = self.sub
+  ev.Publish()
+}
+
+// Run until stopped by signal, Stop or updater self deploy
 func (self *Daemon) Start() {
   glog.Infof("%s", common.CurrentScope())
 
-  switch (os.Getenv("WORK_MODE")) {
+  go self.handleSignals()
+
+  if API_ADDR != "" {
+    self.api = &http.Server{Handler: self.apiHandler()}
+    go self.startApi()
+  }
+
+  // subscription outlives daemon context to publish the stopped event
+  sub_ctx, stop_sub := context.WithCancel(context.Background())
+  var wg sync.WaitGroup
+  run := func(fn func()) {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      fn()
+    }()
+  }
+
+  // subscription set up before anything is published, messages are kept in
+  // outbox until connected
+  mode := os.Getenv("WORK_MODE")
+  if mode != WORK_MODE_SCHED {
+    self.sub.SubUpdate()
+  }
+
+  switch (mode) {
   case WORK_MODE_SUB:
-    self.startSub()
+    run(func() { self.startSub(sub_ctx) })
   case WORK_MODE_SCHED:
-    self.startSched()
+    run(self.startSched)
   case WORK_MODE_DUAL:
-    self.startDual()
+    run(func() { self.startSub(sub_ctx) })
+    run(self.startSched)
   default:
-    self.startDual()
+    run(func() { self.startSub(sub_ctx) })
+    run(self.startSched)
   }
+  self.loadPending()
+  self.loadQueued()
+
+  <-self.ctx.Done()
+  self.shutdown()
+  stop_sub()
+  wg.Wait()
+  glog.Infof("stopped")
 }
@@ -0,0 +1,109 @@
+package updater
+
+import (
+  "time"
+  "testing"
+  "github.com/zex/container-update/state"
+  "github.com/zex/container-update/manifest"
+)
+
+func testMani(created time.Time, digest string) *manifest.UpdateManifest {
+  return &manifest.UpdateManifest{
+    CreatedAt: created,
+    Digest: digest,
+    Components: []manifest.Component{
+      {Name: "web", Force: true},
+      {Name: "db", AllowDowngrade: true},
+    },
+  }
+}
+
+func names(mani *manifest.UpdateManifest) []string {
+  var ret []string
+  for _, comp := range mani.Components {
+    ret = append(ret, comp.Name)
+  }
+  return ret
+}
+
+func TestApplyTarget(t *testing.T) {
+  now := time.Now()
+  last := &state.Record{ManifestCreatedAt: now, ManifestDigest: "d1"}
+
+  // nothing applied yet, or newer manifest
+  for _, rec := range []*state.Record{nil, last} {
+    mani := testMani(now.Add(time.Minute), "d2")
+    got, err := applyTarget(mani, rec)
+    if err != nil || got != mani {
+      t.Errorf("newer manifest: got %v, %v", got, err)
+    }
+  }
+
+  // same manifest again is set up without forcing
+  mani := testMani(now, "d1")
+  got, err := applyTarget(mani, last)
+  if err != nil {
+    t.Fatalf("same manifest: %v", err)
+  }
+  if len(got.Components) != 2 {
+    t.Fatalf("same manifest: got %v", names(got))
+  }
+  for _, comp := range got.Components {
+    if comp.Force {
+      t.Errorf("same manifest: %s still forced", comp.Name)
+    }
+  }
+  if !mani.Components[0].Force {
+    t.Errorf("same manifest: given manifest changed")
+  }
+
+  // same time, other digest, only downgrade allowed components
+  got, err = applyTarget(testMani(now, "d2"), last)
+  if err != nil || len(got.Components) != 1 || got.Components[0].Name != "db" {
+    t.Errorf("other digest: got %v, %v", got, err)
+  }
+
+  // older manifest without downgrade allowed
+  mani = testMani(now.Add(-time.Minute), "d0")
+  mani.Components[1].AllowDowngrade = false
+  if _, err = applyTarget(mani, last); err == nil {
+    t.Errorf("older manifest accepted")
+  } else if _, ok := err.(*ReplayError); !ok {
+    t.Errorf("older manifest: got %T, not ReplayError", err)
+  }
+}
+
+func TestSameApplied(t *testing.T) {
+  now := time.Now()
+  tests := []struct {
+    name string
+    last *state.Record
+    created time.Time
+    want bool
+  }{
+    {"nothing applied", nil, now, false},
+    {"same", &state.Record{ManifestCreatedAt: now, ManifestDigest: "d1"}, now, true},
+    {"legacy record", &state.Record{ManifestCreatedAt: now}, now, true},
+    {"other digest", &state.Record{ManifestCreatedAt: now, ManifestDigest: "d2"}, now, false},
+    {"other time", &state.Record{ManifestCreatedAt: now, ManifestDigest: "d1"}, now.Add(time.Second), false},
+  }
+
+  for _, tt := range tests {
+    if got := sameApplied(testMani(tt.created, "d1"), tt.last); got != tt.want {
+      t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestFilterDowngrade(t *testing.T) {
+  mani := testMani(time.Now(), "d1")
+  got := filterDowngrade(mani)
+
+  // forced component without AllowDowngrade is not downgraded
+  if len(got.Components) != 1 || got.Components[0].Name != "db" {
+    t.Errorf("got %v, want [db]", names(got))
+  }
+  if len(mani.Components) != 2 {
+    t.Errorf("given manifest changed")
+  }
+}
@@ -0,0 +1,114 @@
+package updater
+
+import (
+  "fmt"
+  "github.com/golang/glog"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+)
+
+type SetupFn func(comp *manifest.Component) error
+
+type compResult struct {
+  name string
+  err error
+}
+
+// Run fn for each component with at most limit in parallel, a component
+// starts only after all of its dependencies succeeded, dependents of a failed
+// component are skipped. Dependencies not found in comps are considered done.
+// Component named first runs alone as soon as it's ready, ahead of others.
+// Errors are returned by component name.
+func RunComponents(comps []manifest.Component, limit int, first string, fn SetupFn) map[string]error {
+  glog.Infof("%s (limit=%d)", common.CurrentScope(), limit)
+  if limit < 1 { limit = 1 }
+
+  by_name := make(map[string]*manifest.Component)
+  for i := range comps {
+    by_name[comps[i].Name] = &comps[i]
+  }
+
+  pending := make(map[string]int)
+  dependents := make(map[string][]string)
+  for _, comp := range comps {
+    for _, dep := range comp.DependsOn {
+      if _, ok := by_name[dep]; !ok { continue }
+      pending[comp.Name]++
+      dependents[dep] = append(dependents[dep], comp.Name)
+    }
+  }
+
+  // keep manifest order among ready components, first goes ahead
+  var ready []string
+  push := func(name string) {
+    if name == first {
+      ready = append([]string{name}, ready...)
+      return
+    }
+    ready = append(ready, name)
+  }
+
+  for _, comp := range comps {
+    if pending[comp.Name] == 0 {
+      push(comp.Name)
+    }
+  }
+
+  errs := make(map[string]error)
+  done := make(chan compResult)
+  running := 0
+  // first is running, nothing else is started
+  alone := false
+
+  var skip func(name, cause string)
+  skip = func(name, cause string) {
+    for _, d := range dependents[name] {
+      if _, ok := errs[d]; ok { continue }
+      errs[d] = fmt.Errorf("%s skipped: dependency %s failed", d, cause)
+      skip(d, cause)
+    }
+  }
+
+  for len(ready) > 0 || running > 0 {
+    for len(ready) > 0 && running < limit && !alone {
+      name := ready[0]
+      if _, ok := errs[name]; ok {
+        ready = ready[1:]
+        continue
+      }
+      // wait for running ones to finish
+      if name == first && running > 0 { break }
+      ready = ready[1:]
+
+      running++
+      alone = name == first
+      go func(comp *manifest.Component) {
+        done <- compResult{comp.Name, fn(comp)}
+      }(by_name[name])
+    }
+
+    if running == 0 { break }
+
+    res := <-done
+    running--
+    if res.name == first {
+      alone = false
+    }
+
+    if res.err != nil {
+      errs[res.name] = res.err
+      skip(res.name, res.name)
+      continue
+    }
+
+    for _, d := range dependents[res.name] {
+      pending[d]--
+      if pending[d] == 0 {
+        push(d)
+      }
+    }
+  }
+
+  return errs
+}
@@ -0,0 +1,189 @@
+package updater
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "reflect"
+  "github.com/docker/docker/api/types"
+  "github.com/docker/docker/api/types/container"
+  "github.com/docker/docker/api/types/network"
+
+  "github.com/zex/container-update/manifest"
+)
+
+// Differences between component in manifest and the running container, only
+// fields given in manifest are compared since Docker merges image defaults,
+// env and labels of image config are not counted as removed
+func diffConfig(comp *manifest.Component, info *types.ContainerJSON, image *container.Config) []string {
+  var changes []string
+  if info.Config != nil {
+    changes = append(changes, diffContainerConfig(&comp.ContainerConfig, info.Config, image)...)
+  }
+  if info.HostConfig != nil {
+    changes = append(changes, diffHostConfig(&comp.HostConfig, info.HostConfig)...)
+  }
+  if info.NetworkSettings != nil {
+    changes = append(changes, diffNetConfig(&comp.NetConfig, info.NetworkSettings.Networks)...)
+  }
+  return changes
+}
+
+func diffContainerConfig(want, have, image *container.Config) []string {
+  var changes []string
+
+  changes = append(changes, diffMissing("env", want.Env, have.Env)...)
+  if image != nil {
+    // set in container but neither in manifest nor image defaults
+    known := append(append([]string{}, want.Env...), image.Env...)
+    extra := diffMissing("env", have.Env, known)
+    for _, c := range extra {
+      changes = append(changes, strings.Replace(c, ": +", ": -", 1))
+    }
+  }
+  if len(want.Cmd) > 0 {
+    changes = append(changes, diffValue("cmd", want.Cmd, have.Cmd)...)
+  }
+  if len(want.Entrypoint) > 0 {
+    changes = append(changes, diffValue("entrypoint", want.Entrypoint, have.Entrypoint)...)
+  }
+  if want.User != "" {
+    changes = append(changes, diffValue("user", want.User, have.User)...)
+  }
+  if want.WorkingDir != "" {
+    changes = append(changes, diffValue("working_dir", want.WorkingDir, have.WorkingDir)...)
+  }
+  changes = append(changes, diffValue("tty", want.Tty, have.Tty)...)
+
+  for k, v := range want.Labels {
+    if have.Labels[k] != v {
+      changes = append(changes, fmt.Sprintf("label %s: %q -> %q", k, have.Labels[k], v))
+    }
+  }
+  if image != nil {
+    for k, v := range have.Labels {
+      if _, ok := want.Labels[k]; ok { continue }
+      if d, ok := image.Labels[k]; ok && d == v { continue }
+      changes = append(changes, fmt.Sprintf("label %s: -%q", k, v))
+    }
+  }
+
+  for port := range want.ExposedPorts {
+    if _, ok := have.ExposedPorts[port]; !ok {
+      changes = append(changes, fmt.Sprintf("exposed_ports: +%s", port))
+    }
+  }
+  return changes
+}
+
+func diffHostConfig(want, have *container.HostConfig) []string {
+  var changes []string
+
+  changes = append(changes, diffSet("binds", want.Binds, have.Binds)...)
+  changes = append(changes, diffSet("links", normLinks(want.Links), normLinks(have.Links))...)
+  changes = append(changes, diffSet("devices", devices(want.Devices), devices(have.Devices))...)
+  changes = append(changes, diffSet("dns", want.DNS, have.DNS)...)
+  changes = append(changes, diffSet("extra_hosts", want.ExtraHosts, have.ExtraHosts)...)
+  changes = append(changes, diffSet("cap_add", want.CapAdd, have.CapAdd)...)
+  changes = append(changes, diffValue("privileged", want.Privileged, have.Privileged)...)
+  changes = append(changes, diffValue("restart_policy",
+    normRestart(want.RestartPolicy), normRestart(have.RestartPolicy))...)
+
+  if want.NetworkMode != "" {
+    changes = append(changes, diffValue("network_mode", want.NetworkMode, have.NetworkMode)...)
+  }
+  if want.LogConfig.Type != "" {
+    changes = append(changes, diffValue("log_config", want.LogConfig.Type, have.LogConfig.Type)...)
+    if len(want.LogConfig.Config) > 0 {
+      changes = append(changes, diffValue("log_opts", want.LogConfig.Config, have.LogConfig.Config)...)
+    }
+  }
+  if len(want.PortBindings) > 0 || len(have.PortBindings) > 0 {
+    changes = append(changes, diffValue("port_bindings", want.PortBindings, have.PortBindings)...)
+  }
+  return changes
+}
+
+func diffNetConfig(want *network.NetworkingConfig,
+  have map[string]*network.EndpointSettings) []string {
+  var changes []string
+
+  for name, ep := range want.EndpointsConfig {
+    cur, ok := have[name]
+    if !ok {
+      changes = append(changes, fmt.Sprintf("networks: +%s", name))
+      continue
+    }
+
+    if ep == nil { continue }
+    changes = append(changes, diffMissing(fmt.Sprintf("network %s aliases", name),
+      ep.Aliases, cur.Aliases)...)
+
+    if ep.IPAMConfig != nil && ep.IPAMConfig.IPv4Address != "" {
+      changes = append(changes, diffValue(fmt.Sprintf("network %s ipv4", name),
+        ep.IPAMConfig.IPv4Address, cur.IPAddress)...)
+    }
+  }
+  return changes
+}
+
+func diffValue(field string, want, have interface{}) []string {
+  if reflect.DeepEqual(want, have) {
+    return nil
+  }
+  return []string{fmt.Sprintf("%s: %v -> %v", field, have, want)}
+}
+
+// items of want not found in have
+func diffMissing(field string, want, have []string) []string {
+  var changes []string
+  exist := make(map[string]bool)
+  for _, v := range have { exist[v] = true }
+
+  for _, v := range want {
+    if !exist[v] {
+      changes = append(changes, fmt.Sprintf("%s: +%s", field, v))
+    }
+  }
+  return changes
+}
+
+// items added to or removed from have to get want
+func diffSet(field string, want, have []string) []string {
+  changes := diffMissing(field, want, have)
+  for _, c := range diffMissing(field, have, want) {
+    changes = append(changes, strings.Replace(c, ": +", ": -", 1))
+  }
+  sort.Strings(changes)
+  return changes
+}
+
+// Docker reports links as /name:/container/alias, alias defaults to name
+func normLinks(links []string) []string {
+  var ret []string
+  for _, l := range links {
+    parts := strings.SplitN(l, ":", 2)
+    name := strings.TrimPrefix(parts[0], "/")
+    alias := name
+    if len(parts) > 1 {
+      alias = parts[1][strings.LastIndex(parts[1], "/")+1:]
+    }
+    ret = append(ret, fmt.Sprintf("%s:%s", name, alias))
+  }
+  return ret
+}
+
+func devices(devs []container.DeviceMapping) []string {
+  var ret []string
+  for _, d := range devs {
+    ret = append(ret, fmt.Sprintf("%s:%s:%s", d.PathOnHost, d.PathInContainer, d.CgroupPermissions))
+  }
+  return ret
+}
+
+func normRestart(policy container.RestartPolicy) container.RestartPolicy {
+  if policy.Name == "" {
+    policy.Name = "no"
+  }
+  return policy
+}
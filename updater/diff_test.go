@@ -0,0 +1,73 @@
+package updater
+
+import (
+  "reflect"
+  "testing"
+  "github.com/docker/docker/api/types/container"
+)
+
+func TestNormLinks(t *testing.T) {
+  // as given in manifest
+  want := normLinks([]string{"db", "cache:redis"})
+  // as reported by Docker
+  have := normLinks([]string{"/db:/app/db", "/cache:/app/redis"})
+
+  if exp := []string{"db:db", "cache:redis"}; !reflect.DeepEqual(want, exp) {
+    t.Errorf("manifest links: got %v, want %v", want, exp)
+  }
+  if !reflect.DeepEqual(want, have) {
+    t.Errorf("got %v, want %v", have, want)
+  }
+}
+
+func TestDiffHostConfig(t *testing.T) {
+  want := &container.HostConfig{
+    Binds: []string{"/data:/data"},
+    Links: []string{"db"},
+  }
+  have := &container.HostConfig{
+    Binds: []string{"/data:/data"},
+    Links: []string{"/db:/app/db"},
+    RestartPolicy: container.RestartPolicy{Name: "no"},
+  }
+
+  if changes := diffHostConfig(want, have); len(changes) != 0 {
+    t.Errorf("same config: got %v", changes)
+  }
+
+  have.Binds = []string{"/old:/data"}
+  have.Links = []string{"/db:/app/db", "/cache:/app/cache"}
+  changes := diffHostConfig(want, have)
+  exp := []string{"binds: +/data:/data", "binds: -/old:/data", "links: -cache:cache"}
+  if !reflect.DeepEqual(changes, exp) {
+    t.Errorf("got %v, want %v", changes, exp)
+  }
+}
+
+func TestDiffContainerConfig(t *testing.T) {
+  image := &container.Config{
+    Env: []string{"PATH=/bin"},
+    Labels: map[string]string{"vendor": "zex"},
+  }
+  want := &container.Config{
+    Env: []string{"MODE=prod"},
+    Labels: map[string]string{"app": "web"},
+  }
+  have := &container.Config{
+    Env: []string{"PATH=/bin", "MODE=prod"},
+    Labels: map[string]string{"app": "web", "vendor": "zex"},
+  }
+
+  // image defaults are not counted as changes
+  if changes := diffContainerConfig(want, have, image); len(changes) != 0 {
+    t.Errorf("same config: got %v", changes)
+  }
+
+  have.Env = append(have.Env, "DEBUG=1")
+  have.Labels["extra"] = "1"
+  changes := diffContainerConfig(want, have, image)
+  exp := []string{"env: -DEBUG=1", `label extra: -"1"`}
+  if !reflect.DeepEqual(changes, exp) {
+    t.Errorf("got %v, want %v", changes, exp)
+  }
+}
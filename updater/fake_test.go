@@ -0,0 +1,51 @@
+package updater
+
+import (
+  "sync"
+  "context"
+  "github.com/zex/container-update/common"
+)
+
+// Transport keeping what is published instead of sending it
+type fakeTransport struct {
+  mutex sync.Mutex
+  events [][]byte
+  published map[string][][]byte
+}
+
+func (self *fakeTransport) PublishEvent(data []byte) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  self.events = append(self.events, data)
+  return nil
+}
+
+func (self *fakeTransport) PublishHeartbeat(data []byte) error { return nil }
+
+func (self *fakeTransport) Publish(key string, data []byte) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if self.published == nil {
+    self.published = make(map[string][][]byte)
+  }
+  self.published[key] = append(self.published[key], data)
+  return nil
+}
+
+func (self *fakeTransport) PublishPresence(p *common.Presence) error { return nil }
+
+func (self *fakeTransport) Topic(key string) string { return key }
+
+func (self *fakeTransport) SubUpdate() {}
+
+func (self *fakeTransport) StartSub(ctx context.Context) {}
+
+func (self *fakeTransport) PushAll(topics []string, data []byte) (map[string]error, error) {
+  return nil, nil
+}
+
+func (self *fakeTransport) eventCount() int {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return len(self.events)
+}
@@ -10,6 +10,7 @@ type PostSetupFn func(comp *manifest.Component) error
 type IDocker interface {
   SetupContainer(comp *manifest.Component, post_only bool, funcs... PostSetupFn) error
   NeedUpdate(comp *manifest.Component) bool
+  PlanComponent(comp *manifest.Component) *CompPlan
   ListContainers() ([]types.Container, error)
   ListImages() ([]types.ImageSummary, error)
   GetContainersByName(name string) (*types.Container, error)
@@ -17,13 +18,25 @@ type IDocker interface {
   CopyToContainer(cont *types.Container, src_path, dest_path string) error
 
   FetchImage(comp *manifest.Component) error
+  StageImage(comp *manifest.Component) error
+  ImageStaged(comp *manifest.Component) bool
+  StageLocal(comp *manifest.Component) error
+  PrevImage(comp *manifest.Component, image_id string) string
   CleanupImage(cont *types.Container) error
   CleanupContainer(cont *types.Container) error
   StartContainer(comp *manifest.Component) error
   DeprecateComponent(comp *manifest.Component)
   BackupContainer(comp *manifest.Component) (*types.Container, error)
+  RestoreContainer(comp *manifest.Component, prev *types.Container) error
+  WaitStarted(comp *manifest.Component) error
+  WaitHealthy(comp *manifest.Component) error
+  RestartContainer(name string) error
+  ContainerLogs(name, tail string) (string, error)
+  PruneImages() (*types.ImagesPruneReport, error)
 }
 
 type IUpdater interface {
-  SetupComponents(mani *manifest.UpdateManifest)
+  SetupComponents(mani *manifest.UpdateManifest) error
+  PlanComponents(mani *manifest.UpdateManifest) *Plan
+  StageComponents(mani *manifest.UpdateManifest) error
 }
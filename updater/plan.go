@@ -0,0 +1,168 @@
+package updater
+
+import (
+  "fmt"
+  "time"
+  "strings"
+  "github.com/golang/glog"
+  "github.com/docker/docker/api/types"
+  "github.com/docker/docker/api/types/container"
+  "github.com/containerd/containerd"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+)
+
+type PlanAction string
+
+const (
+  PlanActionNone PlanAction = "none"
+  PlanActionCreate PlanAction = "create"
+  PlanActionUpdate PlanAction = "update"
+  PlanActionDeprecate PlanAction = "deprecate"
+)
+
+// What setup would do to a component
+type CompPlan struct {
+  Name string `json:"name"`
+  ContainerName string `json:"container_name,omitempty"`
+  Action PlanAction `json:"action"`
+  ImageFrom string `json:"image_from,omitempty"`
+  ImageTo string `json:"image_to,omitempty"`
+  // reasons of the action
+  Reasons []string `json:"reasons,omitempty"`
+  // config of running container differs from manifest, container is
+  // recreated on drift
+  Changes []string `json:"changes,omitempty"`
+  Error string `json:"error,omitempty"`
+}
+
+// What setup would do to an update manifest
+type Plan struct {
+  ManifestCreatedAt time.Time `json:"manifest_created_at"`
+  ManifestDigest string `json:"manifest_digest,omitempty"`
+  CreatedAt time.Time `json:"created_at"`
+  // manifest would be refused, components are planned anyway
+  Rejected string `json:"rejected,omitempty"`
+  Components []CompPlan `json:"components"`
+}
+
+func (self *CompPlan) NeedUpdate() bool {
+  return self.Action == PlanActionCreate || self.Action == PlanActionUpdate
+}
+
+// Any component would be touched by setup
+func (self *Plan) NeedUpdate() bool {
+  for i := range self.Components {
+    if self.Components[i].NeedUpdate() || self.Components[i].Action == PlanActionDeprecate {
+      return true
+    }
+  }
+  return false
+}
+
+// Plan component without touching Docker state
+func (self *DockerAdapter) PlanComponent(comp *manifest.Component) *CompPlan {
+  glog.Infof("%s (%s)", common.CurrentScope(), comp.Name)
+
+  plan := &CompPlan{
+    Name: comp.Name,
+    ContainerName: comp.ContainerName,
+    Action: PlanActionNone,
+    ImageTo: comp.ImageRef(),
+  }
+
+  cont, err := self.GetContainersByName(comp.ContainerName)
+  if err != nil {
+    plan.Action = PlanActionUpdate
+    plan.Error = err.Error()
+    return plan
+  }
+
+  if comp.Op == manifest.COMPOP_DEPRECATE {
+    plan.ImageTo = ""
+    if cont != nil {
+      plan.Action = PlanActionDeprecate
+      plan.ImageFrom = cont.Image
+    }
+    return plan
+  }
+
+  if cont == nil {
+    plan.Action = PlanActionCreate
+    plan.Reasons = append(plan.Reasons, "container not found")
+    return plan
+  }
+  plan.ImageFrom = cont.Image
+
+  if comp.Force {
+    plan.Reasons = append(plan.Reasons, "forced")
+  }
+  if cont.State != string(containerd.Running) {
+    plan.Reasons = append(plan.Reasons, fmt.Sprintf("container %s", cont.State))
+  }
+  if strings.Contains(cont.Status, fmt.Sprintf("(%s)", types.Unhealthy)) {
+    plan.Reasons = append(plan.Reasons, "container unhealthy")
+  }
+  if reason := self.imageChanged(comp, cont); reason != "" {
+    plan.Reasons = append(plan.Reasons, reason)
+  }
+
+  if info, err := self.cli.ContainerInspect(self.ctx, cont.ID); err != nil {
+    plan.Error = err.Error()
+  } else {
+    // image defaults unknown, only manifest fields are compared
+    var image *container.Config
+    if img, _, err := self.cli.ImageInspectWithRaw(self.ctx, info.Image); err == nil {
+      image = img.Config
+    }
+    plan.Changes = diffConfig(comp, &info, image)
+  }
+
+  if len(plan.Changes) > 0 {
+    plan.Reasons = append(plan.Reasons, "config drift")
+  }
+
+  if len(plan.Reasons) > 0 {
+    plan.Action = PlanActionUpdate
+  }
+  return plan
+}
+
+func (self *DockerUpdater) PlanComponents(mani *manifest.UpdateManifest) *Plan {
+  glog.Infof("%s", common.CurrentScope())
+
+  plan := &Plan{
+    ManifestCreatedAt: mani.CreatedAt,
+    ManifestDigest: mani.Digest,
+    CreatedAt: time.Now(),
+  }
+
+  for i := range mani.Components {
+    plan.Components = append(plan.Components, *self.adapt.PlanComponent(&mani.Components[i]))
+  }
+  return plan
+}
+
+// Compare image of running container by digest if pinned, by image id of
+// local tag otherwise, empty if not changed
+func (self *DockerAdapter) imageChanged(comp *manifest.Component, cont *types.Container) string {
+  if comp.ImageDigest != "" {
+    info, _, err := self.cli.ImageInspectWithRaw(self.ctx, cont.ImageID)
+    if err != nil || !hasDigest(info.RepoDigests, comp.ImageDigest) {
+      return "image digest changed"
+    }
+    return ""
+  }
+
+  if cont.Image != comp.ContainerConfig.Image {
+    return "image changed"
+  }
+
+  // tag might be pulled again with another image
+  info, _, err := self.cli.ImageInspectWithRaw(self.ctx, comp.ContainerConfig.Image)
+  if err == nil && info.ID != cont.ImageID {
+    return "image id changed"
+  }
+  return ""
+}
@@ -0,0 +1,210 @@
+package updater
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "bytes"
+  "context"
+  "io/ioutil"
+  "net/http"
+  "github.com/golang/glog"
+  "github.com/docker/docker/api/types"
+  "github.com/docker/docker/pkg/stdcopy"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+)
+
+const (
+  PROBE_TIMEOUT_DEFAULT = "5s"
+  PROBE_INTERVAL_DEFAULT = "3s"
+  PROBE_RETRIES_DEFAULT = 10
+  // max bytes of probe output kept for report
+  PROBE_OUTPUT_MAX = 1024
+)
+
+// Wait for component to become healthy, the readiness probe in manifest is
+// preferred, Docker HEALTHCHECK is used otherwise
+func (self *DockerAdapter) WaitHealthy(comp *manifest.Component) error {
+  glog.Infof("%s", common.CurrentScope())
+
+  health := comp.Health
+  if health != nil && (health.Http != "" || health.Tcp != "" || len(health.Exec) > 0) {
+    return self.probe(comp)
+  }
+  return self.waitDockerHealth(comp)
+}
+
+// Timeout, interval and retries of health in manifest, defaults for those
+// not given
+func probeSettings(health *manifest.Health) (time.Duration, time.Duration, int, error) {
+  if health == nil {
+    health = &manifest.Health{}
+  }
+
+  timeout, err := parseDurationOr(health.Timeout, PROBE_TIMEOUT_DEFAULT)
+  if err != nil { return 0, 0, 0, err }
+
+  interval, err := parseDurationOr(health.Interval, PROBE_INTERVAL_DEFAULT)
+  if err != nil { return 0, 0, 0, err }
+
+  retries := health.Retries
+  if retries <= 0 { retries = PROBE_RETRIES_DEFAULT }
+  return timeout, interval, retries, nil
+}
+
+// Poll Docker HEALTHCHECK status, as often and as long as health in manifest
+// says if given
+func (self *DockerAdapter) waitDockerHealth(comp *manifest.Component) error {
+  glog.Infof("%s", common.CurrentScope())
+
+  timeout, interval, retries, err := probeSettings(comp.Health)
+  if err != nil { return err }
+
+  for i := 0; i < retries; i++ {
+    cont, err := self.GetContainersByName(comp.ContainerName)
+    if err != nil { return err }
+    if cont == nil {
+      return fmt.Errorf("%s: container disappeared", comp.ContainerName)
+    }
+
+    ctx, cancel := context.WithTimeout(self.ctx, timeout)
+    info, err := self.cli.ContainerInspect(ctx, cont.ID)
+    cancel()
+    if err != nil { return err }
+
+    // no HEALTHCHECK defined in image
+    if info.State.Health == nil { return nil }
+
+    switch info.State.Health.Status {
+    case types.Healthy:
+      return nil
+    case types.Unhealthy:
+      output := ""
+      if n := len(info.State.Health.Log); n > 0 {
+        output = info.State.Health.Log[n-1].Output
+      }
+      return fmt.Errorf("%s: container unhealthy: %s", comp.ContainerName, output)
+    }
+    if i < retries-1 { time.Sleep(interval) }
+  }
+
+  return fmt.Errorf("%s: container still starting after %d checks",
+    comp.ContainerName, retries)
+}
+
+func (self *DockerAdapter) probe(comp *manifest.Component) error {
+  glog.Infof("%s", common.CurrentScope())
+  health := comp.Health
+
+  timeout, interval, retries, err := probeSettings(health)
+  if err != nil { return err }
+
+  var output string
+  for i := 0; i < retries; i++ {
+    switch {
+    case health.Http != "":
+      output, err = probeHttp(health.Http, timeout)
+    case health.Tcp != "":
+      output, err = probeTcp(health.Tcp, timeout)
+    case len(health.Exec) > 0:
+      output, err = self.probeExec(comp.ContainerName, health.Exec, timeout)
+    default:
+      return fmt.Errorf("%s: no probe defined", comp.Name)
+    }
+
+    if err == nil {
+      glog.Infof("%s: probe succeeded: %s", comp.Name, output)
+      return nil
+    }
+    glog.Infof("[%d] %s: probe failed: %v", i, comp.Name, err)
+    if i < retries-1 { time.Sleep(interval) }
+  }
+
+  return fmt.Errorf("%s: readiness probe failed after %d retries: %v: %s",
+    comp.Name, retries, err, output)
+}
+
+func parseDurationOr(dur_s, def string) (time.Duration, error) {
+  if dur_s == "" { dur_s = def }
+  return time.ParseDuration(dur_s)
+}
+
+func truncOutput(data []byte) string {
+  if len(data) > PROBE_OUTPUT_MAX {
+    data = data[:PROBE_OUTPUT_MAX]
+  }
+  return string(data)
+}
+
+func probeHttp(target string, timeout time.Duration) (string, error) {
+  cli := http.Client{Timeout: timeout}
+  rsp, err := cli.Get(target)
+  if err != nil { return "", err }
+  defer rsp.Body.Close()
+
+  body, _ := ioutil.ReadAll(rsp.Body)
+  output := truncOutput(body)
+
+  if rsp.StatusCode >= http.StatusBadRequest {
+    return output, fmt.Errorf("unexpected status %s", rsp.Status)
+  }
+  return output, nil
+}
+
+func probeTcp(addr string, timeout time.Duration) (string, error) {
+  conn, err := net.DialTimeout("tcp", addr, timeout)
+  if err != nil { return "", err }
+  conn.Close()
+  return fmt.Sprintf("connected to %s", addr), nil
+}
+
+// Run command in container, given up after timeout
+func (self *DockerAdapter) probeExec(name string, cmd []string, timeout time.Duration) (string, error) {
+  cont, err := self.GetContainersByName(name)
+  if err != nil { return "", err }
+  if cont == nil {
+    return "", fmt.Errorf("%s: container not found", name)
+  }
+
+  ctx, cancel := context.WithTimeout(self.ctx, timeout)
+  defer cancel()
+
+  exec, err := self.cli.ContainerExecCreate(ctx, cont.ID, types.ExecConfig{
+    AttachStdout: true,
+    AttachStderr: true,
+    Cmd: cmd,
+  })
+  if err != nil { return "", err }
+
+  attach, err := self.cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+  if err != nil { return "", err }
+  defer attach.Close()
+
+  // hijacked connection does not follow context once established
+  deadline, _ := ctx.Deadline()
+  attach.Conn.SetDeadline(deadline)
+
+  var out bytes.Buffer
+  if _, err := stdcopy.StdCopy(&out, &out, attach.Reader); err != nil {
+    if ctx.Err() != nil || isTimeout(err) {
+      return truncOutput(out.Bytes()), fmt.Errorf("timed out after %v", timeout)
+    }
+    return "", err
+  }
+  output := truncOutput(out.Bytes())
+
+  info, err := self.cli.ContainerExecInspect(ctx, exec.ID)
+  if err != nil { return output, err }
+
+  if info.ExitCode != 0 {
+    return output, fmt.Errorf("exit code %d", info.ExitCode)
+  }
+  return output, nil
+}
+
+func isTimeout(err error) bool {
+  ne, ok := err.(net.Error)
+  return ok && ne.Timeout()
+}
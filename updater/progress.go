@@ -0,0 +1,187 @@
+package updater
+
+import (
+  "io"
+  "fmt"
+  "time"
+  "strings"
+  "encoding/json"
+  "github.com/golang/glog"
+  "github.com/docker/docker/pkg/jsonmessage"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+)
+
+// Statuses Docker reports per layer, id of these messages is a layer id
+var layerStatus = map[string]bool{
+  "Pulling fs layer": true,
+  "Waiting": true,
+  "Downloading": true,
+  "Verifying Checksum": true,
+  "Download complete": true,
+  "Extracting": true,
+  "Pull complete": true,
+  "Already exists": true,
+}
+
+var (
+  // min time between two progress events of a pull
+  PROGRESS_INTERVAL = common.GetEnvOr("PROGRESS_INTERVAL", "5s")
+)
+
+// Aggregated progress of all layers in a pull
+type PullProgress struct {
+  Image string `json:"image"`
+  Current int64 `json:"current"`
+  Total int64 `json:"total"`
+  Layers int `json:"layers"`
+  LayersDone int `json:"layers_done"`
+  // bytes per second since pull started
+  Rate int64 `json:"rate,omitempty"`
+  Eta string `json:"eta,omitempty"`
+  Done bool `json:"done,omitempty"`
+}
+
+type layerProgress struct {
+  current int64
+  total int64
+  done bool
+}
+
+type pullTracker struct {
+  pub common.Publisher
+  comp *manifest.Component
+  image string
+  interval time.Duration
+  start time.Time
+  last time.Time
+  layers map[string]*layerProgress
+  // keep layer order for logging
+  ids []string
+}
+
+func newPullTracker(pub common.Publisher, comp *manifest.Component, image string) *pullTracker {
+  interval, err := time.ParseDuration(PROGRESS_INTERVAL)
+  if err != nil {
+    glog.Errorf("invalid PROGRESS_INTERVAL: %v", err)
+    interval = 5 * time.Second
+  }
+
+  return &pullTracker{
+    pub: pub,
+    comp: comp,
+    image: image,
+    interval: interval,
+    start: time.Now(),
+    layers: make(map[string]*layerProgress),
+  }
+}
+
+// Decode pull stream, error embedded in stream fails the pull
+func (self *pullTracker) Read(body io.Reader) error {
+  dec := json.NewDecoder(body)
+  for {
+    var msg jsonmessage.JSONMessage
+    if err := dec.Decode(&msg); err == io.EOF {
+      break
+    } else if err != nil {
+      return err
+    }
+
+    if msg.Error != nil {
+      return msg.Error
+    }
+    if msg.ErrorMessage != "" {
+      return fmt.Errorf("%s", msg.ErrorMessage)
+    }
+
+    self.update(&msg)
+  }
+
+  self.publish(true)
+  return nil
+}
+
+// Whether message is about a layer, others such as "Pulling from" or
+// "Digest" are about the whole image whatever their id is
+func isLayerMsg(msg *jsonmessage.JSONMessage) bool {
+  if msg.ID == "" { return false }
+  return msg.Progress != nil || layerStatus[msg.Status] ||
+    strings.HasPrefix(msg.Status, "Retrying")
+}
+
+func (self *pullTracker) update(msg *jsonmessage.JSONMessage) {
+  if !isLayerMsg(msg) {
+    glog.Infof("%s: %s", self.image, msg.Status)
+    return
+  }
+
+  layer, ok := self.layers[msg.ID]
+  if !ok {
+    layer = &layerProgress{}
+    self.layers[msg.ID] = layer
+    self.ids = append(self.ids, msg.ID)
+  }
+
+  switch msg.Status {
+  case "Pull complete", "Already exists":
+    layer.done = true
+    layer.current = layer.total
+    glog.Infof("%s: %s", msg.ID, msg.Status)
+  case "Downloading":
+    if msg.Progress != nil {
+      layer.current = msg.Progress.Current
+      layer.total = msg.Progress.Total
+    }
+  }
+
+  if time.Since(self.last) >= self.interval {
+    self.publish(false)
+  }
+}
+
+func (self *pullTracker) progress(done bool) *PullProgress {
+  ret := &PullProgress{
+    Image: self.image,
+    Layers: len(self.layers),
+    Done: done,
+  }
+
+  for _, layer := range self.layers {
+    ret.Current += layer.current
+    ret.Total += layer.total
+    if layer.done { ret.LayersDone++ }
+  }
+
+  elapsed := time.Since(self.start).Seconds()
+  if elapsed > 0 {
+    ret.Rate = int64(float64(ret.Current) / elapsed)
+  }
+
+  if !done && ret.Rate > 0 && ret.Total > ret.Current {
+    eta := time.Duration((ret.Total - ret.Current) / ret.Rate) * time.Second
+    ret.Eta = eta.String()
+  }
+  return ret
+}
+
+func (self *pullTracker) publish(done bool) {
+  self.last = time.Now()
+  if self.pub == nil { return }
+
+  data, err := json.Marshal(self.progress(done))
+  if err != nil {
+    glog.Error(err)
+    return
+  }
+
+  ev := common.NewEvent()
+  ev.Publisher = self.pub
+  ev.Ty = common.EventTypeProgress
+  ev.Component = self.comp.Name
+  ev.Payload = string(data)
+  if err := ev.Publish(); err != nil {
+    glog.Errorf("failed to publish progress: %v", err)
+  }
+}
@@ -0,0 +1,216 @@
+package updater
+
+import (
+  "fmt"
+  "time"
+  "strconv"
+  "strings"
+  "context"
+  "github.com/golang/glog"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+)
+
+var (
+  // attempts after the first failed pull
+  PULL_RETRIES = common.GetEnvOr("PULL_RETRIES", "5")
+  // initial wait between attempts, doubled on each failure up to PULL_BACKOFF_MAX
+  PULL_BACKOFF = common.GetEnvOr("PULL_BACKOFF", "10s")
+  PULL_BACKOFF_MAX = common.GetEnvOr("PULL_BACKOFF_MAX", "10m")
+  // daily local time window pulls are allowed in, e.g. 22:00-06:00, any time if empty
+  PULL_WINDOW = common.GetEnvOr("PULL_WINDOW", "")
+)
+
+// How images are pulled
+type PullStrategy struct {
+  Retries int
+  Backoff time.Duration
+  BackoffMax time.Duration
+  Window *PullWindow
+}
+
+func NewPullStrategy() (*PullStrategy, error) {
+  var err error
+  ret := &PullStrategy{}
+
+  if ret.Retries, err = strconv.Atoi(PULL_RETRIES); err != nil {
+    return nil, fmt.Errorf("invalid PULL_RETRIES: %v", err)
+  }
+
+  if ret.Backoff, err = time.ParseDuration(PULL_BACKOFF); err != nil {
+    return nil, fmt.Errorf("invalid PULL_BACKOFF: %v", err)
+  }
+
+  if ret.BackoffMax, err = time.ParseDuration(PULL_BACKOFF_MAX); err != nil {
+    return nil, fmt.Errorf("invalid PULL_BACKOFF_MAX: %v", err)
+  }
+
+  if PULL_WINDOW != "" {
+    if ret.Window, err = ParsePullWindow(PULL_WINDOW); err != nil {
+      return nil, fmt.Errorf("invalid PULL_WINDOW: %v", err)
+    }
+  }
+  return ret, nil
+}
+
+// Daily time window, offsets from local midnight, may wrap over midnight
+type PullWindow struct {
+  start time.Duration
+  end time.Duration
+}
+
+func parseClock(s string) (time.Duration, error) {
+  t, err := time.Parse("15:04", strings.TrimSpace(s))
+  if err != nil { return 0, err }
+  return time.Duration(t.Hour()) * time.Hour + time.Duration(t.Minute()) * time.Minute, nil
+}
+
+// Parse window in HH:MM-HH:MM
+func ParsePullWindow(s string) (*PullWindow, error) {
+  parts := strings.Split(s, "-")
+  if len(parts) != 2 {
+    return nil, fmt.Errorf("window not in HH:MM-HH:MM: %s", s)
+  }
+
+  start, err := parseClock(parts[0])
+  if err != nil { return nil, err }
+
+  end, err := parseClock(parts[1])
+  if err != nil { return nil, err }
+
+  if start == end {
+    return nil, fmt.Errorf("empty window: %s", s)
+  }
+  return &PullWindow{start: start, end: end}, nil
+}
+
+// Opening and closing time of the current window if now is inside one,
+// of the next one otherwise
+func (self *PullWindow) Next(now time.Time) (time.Time, time.Time) {
+  midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+  // window opened yesterday might still be open
+  for _, day := range []int{-1, 0, 1} {
+    open := midnight.AddDate(0, 0, day).Add(self.start)
+    close := midnight.AddDate(0, 0, day).Add(self.end)
+    if self.end < self.start {
+      close = close.AddDate(0, 0, 1)
+    }
+
+    if now.Before(close) {
+      return open, close
+    }
+  }
+  // never reached
+  return now, now
+}
+
+// Sleep unless context is done first
+func sleepCtx(ctx context.Context, d time.Duration) error {
+  timer := time.NewTimer(d)
+  defer timer.Stop()
+
+  select {
+  case <-ctx.Done():
+    return ctx.Err()
+  case <-timer.C:
+    return nil
+  }
+}
+
+// Wait until pull window opens, context returned is canceled when it closes
+func (self *PullStrategy) waitWindow(ctx context.Context) (context.Context, context.CancelFunc) {
+  if self.Window == nil {
+    return context.WithCancel(ctx)
+  }
+
+  open, close := self.Window.Next(time.Now())
+  if wait := time.Until(open); wait > 0 {
+    glog.Infof("pull window opens at %v", open)
+    sleepCtx(ctx, wait)
+  }
+  return context.WithDeadline(ctx, close)
+}
+
+// Pull image of component with retries, already downloaded layers are kept by
+// Docker so a retried pull resumes from the first incomplete layer, pull is
+// abandoned on shutdown as no container is touched yet
+func (self *DockerAdapter) FetchImage(comp *manifest.Component) error {
+  glog.Infof("%s", common.CurrentScope())
+
+  strategy, err := NewPullStrategy()
+  if err != nil { return err }
+
+  backoff := strategy.Backoff
+  for attempt := 0; ; {
+    ctx, cancel := strategy.waitWindow(self.stop)
+    err := self.pullImage(ctx, comp)
+    closed := ctx.Err() == context.DeadlineExceeded
+    cancel()
+
+    if err == nil {
+      return nil
+    }
+
+    if self.stop.Err() != nil {
+      return fmt.Errorf("pull abandoned: %v", ErrStopping)
+    }
+
+    if closed {
+      glog.Infof("%s: pull window closed, continue in next window", comp.Name)
+      continue
+    }
+
+    if attempt >= strategy.Retries {
+      return fmt.Errorf("pull failed after %d attempts: %v", attempt + 1, err)
+    }
+    attempt++
+
+    glog.Errorf("[%d] %s: pull failed, retry in %v: %v", attempt, comp.Name, backoff, err)
+    if sleepCtx(self.stop, backoff) != nil {
+      return fmt.Errorf("pull abandoned: %v", ErrStopping)
+    }
+    if backoff *= 2; backoff > strategy.BackoffMax {
+      backoff = strategy.BackoffMax
+    }
+  }
+}
+
+// Pull image of component ahead of setup, setup skips pulling staged images
+func (self *DockerAdapter) StageImage(comp *manifest.Component) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), comp.Name)
+
+  if err := self.FetchImage(comp); err != nil {
+    return err
+  }
+
+  self.staged_mutex.Lock()
+  self.staged[comp.ImageRef()] = true
+  self.staged_mutex.Unlock()
+  return nil
+}
+
+// Image of component is staged or pinned by digest and present locally
+func (self *DockerAdapter) ImageStaged(comp *manifest.Component) bool {
+  ref := comp.ImageRef()
+
+  self.staged_mutex.Lock()
+  staged := self.staged[ref]
+  self.staged_mutex.Unlock()
+
+  if comp.ImageDigest != "" {
+    return self.VerifyImageDigest(comp, ref) == nil
+  }
+
+  if !staged { return false }
+  _, _, err := self.cli.ImageInspectWithRaw(self.ctx, ref)
+  return err == nil
+}
+
+// Forget staged image of component, tag is pulled again on next setup
+func (self *DockerAdapter) unstage(comp *manifest.Component) {
+  self.staged_mutex.Lock()
+  delete(self.staged, comp.ImageRef())
+  self.staged_mutex.Unlock()
+}
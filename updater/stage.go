@@ -0,0 +1,200 @@
+package updater
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "github.com/golang/glog"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/state"
+)
+
+const (
+  PENDING_FILE = "pending.json"
+)
+
+// Manifest kept on disk as received, verified again on load, only the named
+// components of it are set up
+type savedMani struct {
+  Envelope *manifest.Envelope `json:"envelope"`
+  Components []string `json:"components"`
+}
+
+func saveMani(name string, mani *manifest.UpdateManifest) error {
+  if mani.Envelope == nil {
+    return fmt.Errorf("manifest not signed")
+  }
+
+  saved := savedMani{Envelope: mani.Envelope}
+  for _, comp := range mani.Components {
+    saved.Components = append(saved.Components, comp.Name)
+  }
+
+  data, err := json.Marshal(&saved)
+  if err != nil { return err }
+  return ioutil.WriteFile(filepath.Join(state.STATE_ROOT, name), data, 0600)
+}
+
+// Verify manifest saved on disk again, nil if none
+func (self *Daemon) loadMani(name string) (*manifest.UpdateManifest, error) {
+  data, err := ioutil.ReadFile(filepath.Join(state.STATE_ROOT, name))
+  if os.IsNotExist(err) { return nil, nil }
+  if err != nil { return nil, err }
+
+  var saved savedMani
+  if err := json.Unmarshal(data, &saved); err != nil {
+    return nil, err
+  }
+  if saved.Envelope == nil {
+    return nil, fmt.Errorf("manifest not signed")
+  }
+
+  mani, err := self.open(saved.Envelope)
+  if err != nil { return nil, err }
+
+  names := make(map[string]bool)
+  for _, name := range saved.Components {
+    names[name] = true
+  }
+
+  comps := mani.Components
+  mani.Components = nil
+  for _, comp := range comps {
+    if names[comp.Name] {
+      mani.Components = append(mani.Components, comp)
+    }
+  }
+  return mani, nil
+}
+
+// Pull images of manifest and keep it pending until activation
+func (self *Daemon) stage(mani *manifest.UpdateManifest) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), mani.Id())
+
+  self.pending_mutex.Lock()
+  same := self.pending != nil && self.pending.Id() == mani.Id()
+  self.pending_mutex.Unlock()
+  if same {
+    glog.Infof("%s already staged", mani.Id())
+    return nil
+  }
+
+  if err := self.up.StageComponents(mani); err != nil {
+    return err
+  }
+
+  self.setPending(mani)
+  self.pubStaged(mani)
+  return nil
+}
+
+func (self *Daemon) setPending(mani *manifest.UpdateManifest) {
+  self.pending_mutex.Lock()
+  defer self.pending_mutex.Unlock()
+
+  if self.pending_timer != nil {
+    self.pending_timer.Stop()
+    self.pending_timer = nil
+  }
+  self.pending = mani
+
+  if err := savePending(mani); err != nil {
+    glog.Errorf("failed to save pending manifest: %v", err)
+  }
+
+  if mani.ActivateAt.IsZero() {
+    glog.Infof("%s staged, waiting for activate command", mani.Id())
+    return
+  }
+
+  glog.Infof("%s staged, activate at %v", mani.Id(), mani.ActivateAt)
+  id := mani.Id()
+  self.pending_timer = time.AfterFunc(time.Until(mani.ActivateAt), func() {
+    if err := self.Activate(id); err != nil {
+      glog.Error(err)
+      self.pubError(err.Error())
+    }
+  })
+}
+
+// Switch containers of the staged manifest, id must match the manifest if given
+func (self *Daemon) Activate(id string) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), id)
+
+  self.pending_mutex.Lock()
+  mani := self.pending
+  if mani == nil {
+    self.pending_mutex.Unlock()
+    return fmt.Errorf("no manifest staged")
+  }
+
+  if id != "" && id != mani.Id() {
+    self.pending_mutex.Unlock()
+    return fmt.Errorf("staged manifest is %s, not %s", mani.Id(), id)
+  }
+
+  if self.pending_timer != nil {
+    self.pending_timer.Stop()
+    self.pending_timer = nil
+  }
+  self.pending = nil
+  os.RemoveAll(filepath.Join(state.STATE_ROOT, PENDING_FILE))
+  self.pending_mutex.Unlock()
+
+  self.apply_mutex.Lock()
+  defer self.apply_mutex.Unlock()
+
+  // keep it on disk, activated after restart
+  if self.ctx.Err() != nil {
+    if err := savePending(mani); err != nil {
+      glog.Errorf("failed to save pending manifest: %v", err)
+    }
+    return ErrStopping
+  }
+
+  // a newer manifest might have been applied meanwhile
+  if last := self.store.LastApplied(); mani.CreatedAt.Before(last) {
+    return &ReplayError{CreatedAt: mani.CreatedAt, LastApplied: last}
+  }
+
+  return self.up.SetupComponents(mani)
+}
+
+// Staged manifest, nil if none
+func (self *Daemon) Pending() *manifest.UpdateManifest {
+  self.pending_mutex.Lock()
+  defer self.pending_mutex.Unlock()
+  return self.pending
+}
+
+// Restore manifest staged before restart, images not pinned by digest are
+// pulled again on activation, called on start as activation may be due
+func (self *Daemon) loadPending() {
+  mani, err := self.loadMani(PENDING_FILE)
+  if err != nil {
+    glog.Errorf("failed to load pending manifest: %v", err)
+    return
+  }
+  if mani != nil {
+    self.setPending(mani)
+  }
+}
+
+func savePending(mani *manifest.UpdateManifest) error {
+  return saveMani(PENDING_FILE, mani)
+}
+
+func (self *Daemon) pubStaged(mani *manifest.UpdateManifest) {
+  glog.Infof("%s", common.CurrentScope())
+
+  ev := common.NewEvent()
+  ev.Publisher = self.sub
+  ev.Ty = common.EventTypeStaged
+  ev.Payload = mani.Id()
+  ev.Publish()
+}
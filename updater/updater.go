@@ -5,15 +5,18 @@ import (
   "fmt"
   "sync"
   "time"
+  "strconv"
+  "strings"
+  "context"
   "io/ioutil"
   "os/exec"
   "path/filepath"
   "github.com/golang/glog"
   "github.com/docker/docker/api/types"
 
-  mq "github.com/zex/container-update/mqtt"
   "github.com/zex/container-update/manifest"
   "github.com/zex/container-update/common"
+  "github.com/zex/container-update/state"
 )
 
 var (
@@ -22,69 +25,96 @@ var (
   UPDATER_IN_CONTAINER = os.Getenv("UPDATER_IN_CONTAINER")
   // paths on host
   UPDATER_ROOT = os.Getenv("UPDATER_ROOT")
+  // max number of components set up in parallel
+  SETUP_CONCURRENCY = common.GetEnvOr("SETUP_CONCURRENCY", "2")
 )
 
 type DockerUpdater struct {
   setup_mutex *sync.Mutex
   adapt IDocker
-  sub *mq.Sub
+  sub common.Publisher
+  store *state.Store
+  // record of manifest being set up
+  rec_mutex *sync.Mutex
+  rec *state.Record
+  // canceled on shutdown, no component is started after
+  stop context.Context
+  // shuts down the daemon, updater is restarted by service manager
+  shutdown context.CancelFunc
 }
 
-func NewDockerUpdater(sub *mq.Sub) *DockerUpdater {
+func NewDockerUpdater(stop context.Context, shutdown context.CancelFunc,
+    sub common.Publisher, store *state.Store) *DockerUpdater {
   return &DockerUpdater {
     setup_mutex: &sync.Mutex{},
-    adapt: NewDockerAdapter(),
+    adapt: NewDockerAdapter(stop, sub),
     sub: sub,
+    store: store,
+    rec_mutex: &sync.Mutex{},
+    stop: stop,
+    shutdown: shutdown,
   }
 }
 
-func (self *DockerUpdater) SetupComponents(mani *manifest.UpdateManifest) {
+// Components not staged or set up, the manifest is worth another try as it's
+// accepted again until it takes effect
+type SetupError struct {
+  Op string
+  Errs []string
+}
+
+func (e *SetupError) Error() string {
+  return fmt.Sprintf("failed to %s: %s", e.Op, strings.Join(e.Errs, "; "))
+}
+
+// Set up components of manifest and journal the outcome, SetupError if any
+// component failed or was skipped
+func (self *DockerUpdater) SetupComponents(mani *manifest.UpdateManifest) error {
   glog.Infof("%s", common.CurrentScope())
   if err := detectEnv(); err != nil {
     glog.Error(err)
-    return
+    return err
+  }
+
+  limit, err := strconv.Atoi(SETUP_CONCURRENCY)
+  if err != nil {
+    glog.Errorf("invalid SETUP_CONCURRENCY: %v", err)
+    limit = 1
   }
 
   self.setup_mutex.Lock()
+  self.rec = &state.Record{
+    ManifestCreatedAt: mani.CreatedAt,
+    ManifestDigest: mani.Digest,
+    AppliedAt: time.Now(),
+  }
+  // updater may be replaced along with its container before record is appended
+  if err := self.store.Begin(*self.rec); err != nil {
+    glog.Errorf("failed to save state: %v", err)
+  }
 
-  for i, comp := range mani.Components {
-    glog.Infof("[%d] setup %v", i, comp)
-    emsg := ""
-
-    switch comp.Name {
-    case manifest.COMP_UPDATER:
-      if self.onUpdaterPostOp() {
-        os.RemoveAll(POST_OP_MARKER)
-        if err := self.adapt.SetupContainer(&comp, true); err != nil {
-            // self.PostSetupDB); err != nil {
-          emsg = fmt.Sprintf("failed to setup container: %v", err)
-          glog.Error(emsg)
-        }
-      } else if !self.adapt.NeedUpdate(&comp) {
-        continue
-      } else {
-        if err := self.setUpdaterPostOp(); err != nil {
-          emsg := fmt.Sprintf("failed to set updater post op: %v", err)
-          glog.Error(emsg)
-        }
-
-        if err := self.adapt.SetupContainer(&comp, false,
-            self.PostSetupUpdater,
-            // updater exits after deploy
-            self.PostSetupUpdaterDeploy); err != nil {
-          emsg := fmt.Sprintf("failed to setup container: %v", err)
-          glog.Error(emsg)
-        }
-      }
-    default:
-      if err := self.adapt.SetupContainer(&comp, false); err != nil {
-        emsg = fmt.Sprintf("failed to setup container: %v", err)
-        glog.Error(emsg)
+  // updater may exit after deploy, it's set up alone once its dependencies
+  // are done and before everything else
+  comps := mani.Components
+  errs := RunComponents(comps, limit, manifest.COMP_UPDATER, self.trackComponent)
+  for _, comp := range comps {
+    if err, ok := errs[comp.Name]; ok {
+      glog.Error(err)
+      if self.stop.Err() == nil {
+        self.pubError(err.Error())
       }
+      self.recordSkipped(&comp, err)
     }
+  }
+
+  if err := self.store.Append(*self.rec); err != nil {
+    glog.Errorf("failed to save state: %v", err)
+  }
 
-    if len(emsg) != 0 {
-      self.pubError(emsg)
+  var failed []string
+  for _, rec := range self.rec.Components {
+    if rec.Outcome == state.OutcomeFailed || rec.Outcome == state.OutcomeSkipped {
+      failed = append(failed, fmt.Sprintf("%s: %s", rec.Name, rec.Error))
     }
   }
 
@@ -92,6 +122,140 @@ func (self *DockerUpdater) SetupComponents(mani *manifest.UpdateManifest) {
     glog.Errorf("heartbeat failed: %v", err)
   }
   self.setup_mutex.Unlock()
+
+  if len(failed) > 0 {
+    return &SetupError{Op: "set up components", Errs: failed}
+  }
+  return nil
+}
+
+// Pull images of components to update ahead of setup, components up to date
+// are skipped
+func (self *DockerUpdater) StageComponents(mani *manifest.UpdateManifest) error {
+  glog.Infof("%s", common.CurrentScope())
+
+  var errs []string
+  for i := range mani.Components {
+    comp := &mani.Components[i]
+    if comp.Op == manifest.COMPOP_DEPRECATE { continue }
+    if self.stop.Err() != nil {
+      return fmt.Errorf("failed to stage images: %v", ErrStopping)
+    }
+
+    if plan := self.adapt.PlanComponent(comp); !plan.NeedUpdate() && !comp.Force {
+      glog.Infof("%s: up to date, not staged", comp.Name)
+      continue
+    }
+
+    if err := self.adapt.StageImage(comp); err != nil {
+      errs = append(errs, fmt.Sprintf("%s: %v", comp.Name, err))
+    }
+  }
+
+  if len(errs) > 0 {
+    return &SetupError{Op: "stage images", Errs: errs}
+  }
+  return nil
+}
+
+// Set up component and record images before and after, components not
+// started yet are skipped on shutdown
+func (self *DockerUpdater) trackComponent(comp *manifest.Component) error {
+  if self.stop.Err() != nil {
+    return fmt.Errorf("%s: not set up: %v", comp.Name, ErrStopping)
+  }
+
+  spec := *comp
+  rec := state.CompRecord{
+    Name: comp.Name,
+    ContainerName: comp.ContainerName,
+    StartedAt: time.Now(),
+    Spec: &spec,
+  }
+
+  if prev, err := self.adapt.GetContainersByName(comp.ContainerName); err == nil && prev != nil {
+    rec.PrevImage, rec.PrevDigest = prev.Image, prev.ImageID
+  }
+
+  if plan := self.adapt.PlanComponent(comp); plan.NeedUpdate() || comp.Force {
+    rec.Reasons = append(plan.Reasons, plan.Changes...)
+  }
+
+  err := self.setupComponent(comp)
+  rec.FinishedAt = time.Now()
+
+  if cur, e := self.adapt.GetContainersByName(comp.ContainerName); e == nil && cur != nil {
+    rec.Image, rec.Digest = cur.Image, cur.ImageID
+  }
+
+  switch {
+  case err != nil:
+    rec.Outcome = state.OutcomeFailed
+    rec.Error = err.Error()
+  case len(rec.Reasons) == 0 && rec.Digest == rec.PrevDigest && rec.Image == rec.PrevImage:
+    rec.Outcome = state.OutcomeUnchanged
+  default:
+    rec.Outcome = state.OutcomeUpdated
+    self.pubUpdated(comp, rec.Reasons)
+  }
+
+  self.rec_mutex.Lock()
+  self.rec.Components = append(self.rec.Components, rec)
+  if e := self.store.Begin(*self.rec); e != nil {
+    glog.Errorf("failed to save state: %v", e)
+  }
+  self.rec_mutex.Unlock()
+  return err
+}
+
+// Record component not set up, no-op if already recorded
+func (self *DockerUpdater) recordSkipped(comp *manifest.Component, err error) {
+  self.rec_mutex.Lock()
+  defer self.rec_mutex.Unlock()
+
+  for _, rec := range self.rec.Components {
+    if rec.Name == comp.Name { return }
+  }
+
+  self.rec.Components = append(self.rec.Components, state.CompRecord{
+    Name: comp.Name,
+    ContainerName: comp.ContainerName,
+    Outcome: state.OutcomeSkipped,
+    Error: err.Error(),
+  })
+}
+
+func (self *DockerUpdater) setupComponent(comp *manifest.Component) error {
+  glog.Infof("%s (%s)", common.CurrentScope(), comp.Name)
+
+  switch comp.Name {
+  case manifest.COMP_UPDATER:
+    if self.onUpdaterPostOp() {
+      os.RemoveAll(POST_OP_MARKER)
+      if err := self.adapt.SetupContainer(comp, true); err != nil {
+          // self.PostSetupDB); err != nil {
+        return fmt.Errorf("failed to setup container: %v", err)
+      }
+    } else if !self.adapt.NeedUpdate(comp) {
+      return nil
+    } else {
+      if err := self.setUpdaterPostOp(); err != nil {
+        glog.Errorf("failed to set updater post op: %v", err)
+      }
+
+      if err := self.adapt.SetupContainer(comp, false,
+          self.PostSetupUpdater,
+          // updater exits after deploy
+          self.PostSetupUpdaterDeploy); err != nil {
+        return fmt.Errorf("failed to setup container: %v", err)
+      }
+    }
+  default:
+    if err := self.adapt.SetupContainer(comp, false); err != nil {
+      return fmt.Errorf("%s: failed to setup container: %v", comp.Name, err)
+    }
+  }
+  return nil
 }
 
 // Post Operation callback
@@ -114,8 +278,9 @@ func (self *DockerUpdater) PostSetupUpdaterDeploy(comp *manifest.Component) erro
     return err
   }
   */
-  self.setup_mutex.Unlock()
-  os.Exit(1)
+  // components left are skipped, updater restarts with the new deploy
+  glog.Infof("updater deployed, shutting down")
+  self.shutdown()
 
   return nil
 }
@@ -206,18 +371,27 @@ func (self *DockerUpdater) heartbeatUpdate() error {
   hb.Publisher = self.sub
 
   if hb.Containers, err = self.adapt.ListContainers(); err != nil {
-    hb.Error = fmt.Sprintf("failed to list containers", err)
+    hb.Error = fmt.Sprintf("failed to list containers: %v", err)
     return hb.Publish()
   }
 
   if hb.Images, err = self.adapt.ListImages(); err != nil {
-    hb.Error = fmt.Sprintf("failed to list images", err)
+    hb.Error = fmt.Sprintf("failed to list images: %v", err)
     return hb.Publish()
   }
 
   return hb.Publish()
 }
 
+func (self *DockerUpdater) pubUpdated(comp *manifest.Component, reasons []string) {
+  ev := common.NewEvent()
+  ev.Publisher = self.sub
+  ev.Ty = common.EventTypeUpdated
+  ev.Component = comp.Name
+  ev.Payload = strings.Join(reasons, "; ")
+  ev.Publish()
+}
+
 func (self *DockerUpdater) pubError(e string) {
   ev := common.NewErrEvent(e)
   ev.Publisher = self.sub
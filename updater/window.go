@@ -0,0 +1,227 @@
+package updater
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "path/filepath"
+  "github.com/golang/glog"
+  "github.com/robfig/cron"
+
+  "github.com/zex/container-update/manifest"
+  "github.com/zex/container-update/common"
+  "github.com/zex/container-update/state"
+)
+
+var (
+  // maintenance window, updates are applied any time if cron is empty
+  MAINT_WINDOW_CRON = os.Getenv("MAINT_WINDOW_CRON")
+  MAINT_WINDOW_DURATION = common.GetEnvOr("MAINT_WINDOW_DURATION", "2h")
+  MAINT_WINDOW_TZ = os.Getenv("MAINT_WINDOW_TZ")
+)
+
+const (
+  QUEUED_FILE = "queued.json"
+)
+
+type Window struct {
+  sched cron.Schedule
+  dur time.Duration
+  loc *time.Location
+}
+
+func NewWindow(mw *manifest.MaintWindow) (*Window, error) {
+  sched, err := cron.ParseStandard(mw.Cron)
+  if err != nil {
+    return nil, fmt.Errorf("invalid window cron: %v", err)
+  }
+
+  dur, err := time.ParseDuration(mw.Duration)
+  if err != nil {
+    return nil, fmt.Errorf("invalid window duration: %v", err)
+  }
+
+  loc, err := time.LoadLocation(mw.Timezone)
+  if err != nil {
+    return nil, fmt.Errorf("invalid window timezone: %v", err)
+  }
+  return &Window{sched: sched, dur: dur, loc: loc}, nil
+}
+
+// Window given by manifest, by env otherwise, nil if neither
+func windowOf(mani *manifest.UpdateManifest) (*Window, error) {
+  if mani.Window != nil {
+    return NewWindow(mani.Window)
+  }
+
+  if MAINT_WINDOW_CRON == "" {
+    return nil, nil
+  }
+
+  return NewWindow(&manifest.MaintWindow{
+    Cron: MAINT_WINDOW_CRON,
+    Duration: MAINT_WINDOW_DURATION,
+    Timezone: MAINT_WINDOW_TZ,
+  })
+}
+
+// Window opened within the last duration is still open
+func (self *Window) Contains(now time.Time) bool {
+  open := self.sched.Next(now.In(self.loc).Add(-self.dur))
+  return !open.After(now)
+}
+
+// Time the window opens next, now if open
+func (self *Window) NextOpen(now time.Time) time.Time {
+  if self.Contains(now) {
+    return now
+  }
+  return self.sched.Next(now.In(self.loc))
+}
+
+// Split components to those bypassing window and the others
+func splitUrgent(mani *manifest.UpdateManifest) (*manifest.UpdateManifest, *manifest.UpdateManifest) {
+  urgent, rest := *mani, *mani
+  urgent.Components, rest.Components = nil, nil
+
+  for _, comp := range mani.Components {
+    if comp.Urgent || comp.Force {
+      urgent.Components = append(urgent.Components, comp)
+    } else {
+      rest.Components = append(rest.Components, comp)
+    }
+  }
+  return &urgent, &rest
+}
+
+// Set up components now if in maintenance window, queue them until window
+// opens otherwise, urgent components are set up right away
+func (self *Daemon) setupInWindow(mani *manifest.UpdateManifest) error {
+  glog.Infof("%s", common.CurrentScope())
+
+  win, err := windowOf(mani)
+  if err != nil {
+    return err
+  }
+
+  now := time.Now()
+  if win == nil || win.Contains(now) {
+    return self.up.SetupComponents(mani)
+  }
+
+  urgent, rest := splitUrgent(mani)
+  if len(rest.Components) > 0 {
+    self.queue(rest, win.NextOpen(now))
+  }
+
+  if len(urgent.Components) > 0 {
+    glog.Infof("%d urgent component(s) bypass window", len(urgent.Components))
+    return self.up.SetupComponents(urgent)
+  }
+  return nil
+}
+
+// Keep manifest until window opens, older manifest in queue is replaced
+func (self *Daemon) queue(mani *manifest.UpdateManifest, open time.Time) {
+  glog.Infof("%s (%s, open=%v)", common.CurrentScope(), mani.Id(), open)
+
+  self.queue_mutex.Lock()
+  defer self.queue_mutex.Unlock()
+
+  if self.queued != nil && mani.CreatedAt.Before(self.queued.CreatedAt) {
+    glog.Infof("newer manifest %s already queued", self.queued.Id())
+    return
+  }
+  if self.queued != nil && mani.Id() == self.queued.Id() {
+    glog.Infof("%s already queued", mani.Id())
+    return
+  }
+
+  if self.queue_timer != nil {
+    self.queue_timer.Stop()
+  }
+  self.queued = mani
+  self.queue_timer = time.AfterFunc(time.Until(open), self.applyQueued)
+
+  if err := saveQueued(mani); err != nil {
+    glog.Errorf("failed to save queued manifest: %v", err)
+  }
+  self.pubQueued(mani, open)
+}
+
+func (self *Daemon) applyQueued() {
+  glog.Infof("%s", common.CurrentScope())
+
+  self.queue_mutex.Lock()
+  mani := self.queued
+  self.queued, self.queue_timer = nil, nil
+  os.RemoveAll(filepath.Join(state.STATE_ROOT, QUEUED_FILE))
+  self.queue_mutex.Unlock()
+
+  if mani == nil { return }
+
+  self.apply_mutex.Lock()
+  defer self.apply_mutex.Unlock()
+
+  // keep it on disk, queued again after restart
+  if self.ctx.Err() != nil {
+    if err := saveQueued(mani); err != nil {
+      glog.Errorf("failed to save queued manifest: %v", err)
+    }
+    return
+  }
+
+  // a newer manifest might have been applied meanwhile
+  if last := self.store.LastApplied(); mani.CreatedAt.Before(last) {
+    err := &ReplayError{CreatedAt: mani.CreatedAt, LastApplied: last}
+    self.pubApplyError(err)
+    return
+  }
+
+  // failures are published by component
+  if err := self.up.SetupComponents(mani); err != nil {
+    glog.Error(err)
+  }
+}
+
+// Queued manifest, nil if none
+func (self *Daemon) Queued() *manifest.UpdateManifest {
+  self.queue_mutex.Lock()
+  defer self.queue_mutex.Unlock()
+  return self.queued
+}
+
+// Restore manifest queued before restart, called on start so the queued
+// event goes out on the connected transport
+func (self *Daemon) loadQueued() {
+  mani, err := self.loadMani(QUEUED_FILE)
+  if err != nil {
+    glog.Errorf("failed to load queued manifest: %v", err)
+    return
+  }
+  if mani == nil { return }
+
+  win, err := windowOf(mani)
+  if err != nil {
+    glog.Errorf("failed to load queued manifest: %v", err)
+    return
+  }
+
+  open := time.Now()
+  if win != nil {
+    open = win.NextOpen(open)
+  }
+  self.queue(mani, open)
+}
+
+func saveQueued(mani *manifest.UpdateManifest) error {
+  return saveMani(QUEUED_FILE, mani)
+}
+
+func (self *Daemon) pubQueued(mani *manifest.UpdateManifest, open time.Time) {
+  ev := common.NewEvent()
+  ev.Publisher = self.sub
+  ev.Ty = common.EventTypeQueued
+  ev.Payload = fmt.Sprintf("%s until %s", mani.Id(), open.Format(time.RFC3339))
+  ev.Publish()
+}
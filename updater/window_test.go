@@ -0,0 +1,138 @@
+package updater
+
+import (
+  "sync"
+  "time"
+  "testing"
+  "github.com/zex/container-update/manifest"
+)
+
+func TestNewWindow(t *testing.T) {
+  tests := []manifest.MaintWindow{
+    {Cron: "not cron", Duration: "1h"},
+    {Cron: "0 2 * * *", Duration: "long"},
+    {Cron: "0 2 * * *", Duration: "1h", Timezone: "Nowhere/Town"},
+  }
+  for _, mw := range tests {
+    if _, err := NewWindow(&mw); err == nil {
+      t.Errorf("%+v accepted", mw)
+    }
+  }
+}
+
+func TestWindow(t *testing.T) {
+  win, err := NewWindow(&manifest.MaintWindow{
+    Cron: "0 2 * * *",
+    Duration: "2h",
+    Timezone: "Asia/Tokyo",
+  })
+  if err != nil { t.Fatal(err) }
+
+  loc, _ := time.LoadLocation("Asia/Tokyo")
+  day := func(hour, min int) time.Time {
+    return time.Date(2024, 5, 10, hour, min, 0, 0, loc)
+  }
+
+  tests := []struct {
+    now time.Time
+    open bool
+    next time.Time
+  }{
+    {day(1, 59), false, day(2, 0)},
+    {day(2, 0), true, day(2, 0)},
+    {day(3, 59), true, day(3, 59)},
+    // window closes as duration elapses
+    {day(4, 0), false, day(2, 0).AddDate(0, 0, 1)},
+    {day(4, 1), false, day(2, 0).AddDate(0, 0, 1)},
+    // same instants given in UTC
+    {day(3, 0).UTC(), true, day(3, 0)},
+    {day(12, 0).UTC(), false, day(2, 0).AddDate(0, 0, 1)},
+  }
+
+  for _, tt := range tests {
+    if got := win.Contains(tt.now); got != tt.open {
+      t.Errorf("%v: open %v, want %v", tt.now, got, tt.open)
+    }
+    if got := win.NextOpen(tt.now); !got.Equal(tt.next) {
+      t.Errorf("%v: next open %v, want %v", tt.now, got, tt.next)
+    }
+  }
+}
+
+func TestWindowOf(t *testing.T) {
+  defer func(cron string) { MAINT_WINDOW_CRON = cron }(MAINT_WINDOW_CRON)
+
+  MAINT_WINDOW_CRON = ""
+  if win, err := windowOf(&manifest.UpdateManifest{}); win != nil || err != nil {
+    t.Errorf("no window: got %v, %v", win, err)
+  }
+
+  // manifest overrides env
+  MAINT_WINDOW_CRON = "bad"
+  mani := &manifest.UpdateManifest{
+    Window: &manifest.MaintWindow{Cron: "0 2 * * *", Duration: "1h"},
+  }
+  if win, err := windowOf(mani); win == nil || err != nil {
+    t.Errorf("manifest window: got %v, %v", win, err)
+  }
+  if _, err := windowOf(&manifest.UpdateManifest{}); err == nil {
+    t.Errorf("invalid env window accepted")
+  }
+}
+
+func TestSplitUrgent(t *testing.T) {
+  mani := &manifest.UpdateManifest{
+    Components: []manifest.Component{
+      {Name: "web"},
+      {Name: "fix", Urgent: true},
+      {Name: "db", Force: true},
+    },
+  }
+
+  urgent, rest := splitUrgent(mani)
+  if len(urgent.Components) != 2 || urgent.Components[0].Name != "fix" ||
+      urgent.Components[1].Name != "db" {
+    t.Errorf("urgent: got %v", names(urgent))
+  }
+  if len(rest.Components) != 1 || rest.Components[0].Name != "web" {
+    t.Errorf("rest: got %v", names(rest))
+  }
+  if len(mani.Components) != 3 {
+    t.Errorf("given manifest changed")
+  }
+}
+
+func TestQueue(t *testing.T) {
+  sub := &fakeTransport{}
+  daemon := &Daemon{queue_mutex: &sync.Mutex{}, sub: sub}
+  defer func() {
+    if daemon.queue_timer != nil { daemon.queue_timer.Stop() }
+  }()
+
+  now := time.Now()
+  open := now.Add(time.Hour)
+  first := &manifest.UpdateManifest{CreatedAt: now, Digest: "d1"}
+
+  daemon.queue(first, open)
+  if daemon.Queued() != first || sub.eventCount() != 1 {
+    t.Fatalf("not queued")
+  }
+
+  // same manifest again, e.g. redelivered, is not queued twice
+  daemon.queue(&manifest.UpdateManifest{CreatedAt: now, Digest: "d1"}, open)
+  if daemon.Queued() != first || sub.eventCount() != 1 {
+    t.Errorf("same manifest queued again")
+  }
+
+  // older manifest does not replace queued one
+  daemon.queue(&manifest.UpdateManifest{CreatedAt: now.Add(-time.Minute), Digest: "d0"}, open)
+  if daemon.Queued() != first {
+    t.Errorf("older manifest replaced queued one")
+  }
+
+  newer := &manifest.UpdateManifest{CreatedAt: now.Add(time.Minute), Digest: "d2"}
+  daemon.queue(newer, open)
+  if daemon.Queued() != newer || sub.eventCount() != 2 {
+    t.Errorf("newer manifest not queued")
+  }
+}